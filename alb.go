@@ -0,0 +1,152 @@
+package awsapigatewayv2handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// HandleALB handles Application Load Balancer target group events. The event is converted to a
+// HTTP request and handled in the same way as an API Gateway event, so all of the LambdaHandler
+// options apply.
+//
+// If multi-value headers are enabled on the target group, the response contains multi-value
+// headers. Otherwise, header values are combined, and only the first cookie is returned.
+func (lh LambdaHandler) HandleALB(ctx context.Context, e events.ALBTargetGroupRequest) (resp events.ALBTargetGroupResponse, err error) {
+	multiValue := len(e.MultiValueHeaders) > 0 || len(e.MultiValueQueryStringParameters) > 0
+	inv := invocation{
+		method:      e.HTTPMethod,
+		path:        e.Path,
+		userAgent:   e.Headers["user-agent"],
+		headerCount: len(e.Headers),
+		headerBytes: getMultiValueHeaderBytes(e.Headers, e.MultiValueHeaders),
+		body:        e.Body,
+		isBase64:    e.IsBase64Encoded,
+		header:      getHeaderFunc(e.Headers, e.MultiValueHeaders),
+	}
+	if multiValue {
+		inv.headerCount = len(e.MultiValueHeaders)
+		if values := e.MultiValueHeaders["user-agent"]; len(values) > 0 {
+			inv.userAgent = values[0]
+		}
+	}
+	v2, err := lh.handle(withALBEvent(ctx, e), inv, func() (*http.Request, error) {
+		return lh.convertALBEventToHTTPRequest(e)
+	})
+	if err != nil {
+		return
+	}
+	return lh.convertV2ResponseToALB(v2, multiValue), nil
+}
+
+// convertV2ResponseToALB converts a V2 response to the ALB format, using multi-value headers if
+// they're enabled on the target group.
+func (lh LambdaHandler) convertV2ResponseToALB(v2 events.APIGatewayV2HTTPResponse, multiValue bool) (resp events.ALBTargetGroupResponse) {
+	resp = events.ALBTargetGroupResponse{
+		StatusCode:        v2.StatusCode,
+		StatusDescription: statusDescription(v2.StatusCode),
+		Body:              v2.Body,
+		IsBase64Encoded:   v2.IsBase64Encoded,
+	}
+	headers := headersWithCookies(v2)
+	if multiValue {
+		resp.MultiValueHeaders = headers
+		return resp
+	}
+	resp.Headers = make(map[string]string, len(v2.Headers)+len(headers))
+	for k, v := range v2.Headers {
+		resp.Headers[k] = v
+	}
+	for k, values := range headers {
+		if len(values) == 0 {
+			continue
+		}
+		if http.CanonicalHeaderKey(k) == "Set-Cookie" {
+			if len(values) > 1 {
+				lh.logError(fmt.Errorf("discarded %d cookies, because multi-value headers are not enabled on the target group", len(values)-1))
+			}
+			resp.Headers[k] = values[0]
+			continue
+		}
+		resp.Headers[k] = strings.Join(values, ", ")
+	}
+	return resp
+}
+
+func (lh LambdaHandler) convertALBEventToHTTPRequest(e events.ALBTargetGroupRequest) (req *http.Request, err error) {
+	body, cl, getBody, err := getRequestBody(e.Body, e.IsBase64Encoded)
+	if err != nil {
+		return
+	}
+	req, err = http.NewRequest(e.HTTPMethod, "/", body)
+	if err != nil {
+		return
+	}
+	req.GetBody = getBody
+	// ALB doesn't decode the path or query string.
+	if req.URL, err = parseRequestPath(lh.trimBasePath(e.Path, "")); err != nil {
+		return
+	}
+	if lh.CleanPath {
+		cleanPath(req.URL)
+	}
+	req.URL.RawQuery = getALBQuery(e)
+	req.RequestURI = requestURI(e.Path, req.URL.RawQuery)
+	if len(e.MultiValueHeaders) > 0 {
+		for k, values := range e.MultiValueHeaders {
+			for _, v := range values {
+				req.Header.Add(k, v)
+			}
+		}
+	} else {
+		for k, v := range e.Headers {
+			req.Header.Add(k, v)
+		}
+	}
+	setRequestHeaders(req, cl)
+	setHost(req, "")
+	return
+}
+
+// getALBQuery returns the raw query string of the event. The parameters are already encoded.
+func getALBQuery(e events.ALBTargetGroupRequest) string {
+	query := e.MultiValueQueryStringParameters
+	if len(query) == 0 {
+		query = make(map[string][]string, len(e.QueryStringParameters))
+		for k, v := range e.QueryStringParameters {
+			query[k] = []string{v}
+		}
+	}
+	// Sort the keys for consistency, in the same way as url.Values.Encode.
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for _, k := range keys {
+		for _, v := range query[k] {
+			if sb.Len() > 0 {
+				sb.WriteByte('&')
+			}
+			sb.WriteString(k)
+			sb.WriteByte('=')
+			sb.WriteString(v)
+		}
+	}
+	return sb.String()
+}
+
+// statusDescription returns the status line text required by ALB responses, e.g. "200 OK".
+func statusDescription(code int) string {
+	text := http.StatusText(code)
+	if text == "" {
+		return strconv.Itoa(code)
+	}
+	return strconv.Itoa(code) + " " + text
+}
@@ -0,0 +1,112 @@
+package awsapigatewayv2handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestALBEvents(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		expected events.ALBTargetGroupResponse
+	}{
+		{
+			name: "single-value headers",
+			payload: `{
+				"requestContext": {"elb": {"targetGroupArn": "arn:aws:elasticloadbalancing:region:123456789012:targetgroup/my-target-group/6d0ecf831eec9f09"}},
+				"httpMethod": "GET",
+				"path": "/hello%20world",
+				"queryStringParameters": {"id": "a%26b"},
+				"headers": {"accept": "text/plain", "user-agent": "test"},
+				"body": "",
+				"isBase64Encoded": false
+			}`,
+			expected: events.ALBTargetGroupResponse{
+				StatusCode:        http.StatusCreated,
+				StatusDescription: "201 Created",
+				Headers: map[string]string{
+					"Set-Cookie": "a=1",
+					"X-Values":   "1, 2",
+				},
+				Body: "/hello world?id=a&b",
+			},
+		},
+		{
+			name: "multi-value headers",
+			payload: `{
+				"requestContext": {"elb": {"targetGroupArn": "arn:aws:elasticloadbalancing:region:123456789012:targetgroup/my-target-group/6d0ecf831eec9f09"}},
+				"httpMethod": "GET",
+				"path": "/hello%20world",
+				"multiValueQueryStringParameters": {"id": ["a%26b"]},
+				"multiValueHeaders": {"accept": ["text/plain"], "user-agent": ["test"]},
+				"body": "",
+				"isBase64Encoded": false
+			}`,
+			expected: events.ALBTargetGroupResponse{
+				StatusCode:        http.StatusCreated,
+				StatusDescription: "201 Created",
+				MultiValueHeaders: map[string][]string{
+					"Set-Cookie": {"a=1", "b=2"},
+					"X-Values":   {"1", "2"},
+				},
+				Body: "/hello world?id=a&b",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Accept") != "text/plain" {
+					t.Errorf("expected Accept header %q, got %q", "text/plain", r.Header.Get("Accept"))
+				}
+				w.Header().Add("X-Values", "1")
+				w.Header().Add("X-Values", "2")
+				http.SetCookie(w, &http.Cookie{Name: "a", Value: "1"})
+				http.SetCookie(w, &http.Cookie{Name: "b", Value: "2"})
+				w.WriteHeader(http.StatusCreated)
+				io.WriteString(w, r.URL.Path+"?id="+r.URL.Query().Get("id"))
+			}))
+			lh.OnError = func(err error) {}
+
+			raw, err := lh.Invoke(context.Background(), []byte(test.payload))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var actual events.ALBTargetGroupResponse
+			if err := json.Unmarshal(raw, &actual); err != nil {
+				t.Fatalf("error unmarshalling response: %v", err)
+			}
+			if diff := cmp.Diff(test.expected, actual); diff != "" {
+				t.Errorf("unexpected response:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestStatusDescription(t *testing.T) {
+	tests := []struct {
+		code     int
+		expected string
+	}{
+		{200, "200 OK"},
+		{201, "201 Created"},
+		{404, "404 Not Found"},
+		{502, "502 Bad Gateway"},
+		{599, "599"},
+	}
+	for _, test := range tests {
+		t.Run(test.expected, func(t *testing.T) {
+			if actual := statusDescription(test.code); actual != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package awsapigatewayv2handler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// ResponseCapture retains the last response returned by a LambdaHandler, so that it can be
+// inspected in tests and during debugging without invoking the handler again.
+type ResponseCapture struct {
+	m        sync.Mutex
+	response events.APIGatewayV2HTTPResponse
+	captured bool
+}
+
+func (c *ResponseCapture) set(resp events.APIGatewayV2HTTPResponse) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.response = resp
+	c.captured = true
+}
+
+// Last returns the last response captured. ok is false if no response has been captured.
+func (c *ResponseCapture) Last() (resp events.APIGatewayV2HTTPResponse, ok bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.response, c.captured
+}
+
+// Exchange is a request and response handled by a LambdaHandler.
+type Exchange struct {
+	Time       time.Time
+	Method     string
+	Path       string
+	StatusCode int
+	// RequestBody is the body of the event, which may be base64 encoded. It is empty unless
+	// CaptureHistoryBodies is enabled.
+	RequestBody string
+	// ResponseBody is the body of the response, which may be base64 encoded. It is empty
+	// unless CaptureHistoryBodies is enabled.
+	ResponseBody string
+}
+
+// History returns the exchanges retained by CaptureHistory, oldest first.
+func (lh LambdaHandler) History() []Exchange {
+	if lh.CaptureHistory == nil {
+		return nil
+	}
+	return lh.CaptureHistory.Exchanges()
+}
+
+func (lh LambdaHandler) newExchange(start time.Time, inv invocation, resp events.APIGatewayV2HTTPResponse) Exchange {
+	e := Exchange{
+		Time:       start,
+		Method:     inv.method,
+		Path:       inv.path,
+		StatusCode: resp.StatusCode,
+	}
+	if lh.CaptureHistoryBodies {
+		e.RequestBody = inv.body
+		e.ResponseBody = resp.Body
+	}
+	return e
+}
+
+// ExchangeHistory retains the most recent exchanges handled by a LambdaHandler, so that they can
+// be inspected, e.g. by a debugging endpoint.
+type ExchangeHistory struct {
+	// Size is the number of exchanges retained.
+	Size int
+
+	m         sync.Mutex
+	exchanges []Exchange
+	next      int
+}
+
+func (h *ExchangeHistory) add(e Exchange) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	size := h.Size
+	if size <= 0 {
+		h.exchanges, h.next = nil, 0
+		return
+	}
+	if len(h.exchanges) > size || (len(h.exchanges) < size && h.next != 0) {
+		// The size has changed, so restore the order, keeping the most recent exchanges.
+		ordered := h.ordered()
+		if len(ordered) > size {
+			ordered = ordered[len(ordered)-size:]
+		}
+		h.exchanges, h.next = ordered, 0
+	}
+	if len(h.exchanges) < size {
+		h.exchanges = append(h.exchanges, e)
+		return
+	}
+	h.exchanges[h.next] = e
+	h.next = (h.next + 1) % size
+}
+
+// Exchanges returns the retained exchanges, oldest first.
+func (h *ExchangeHistory) Exchanges() []Exchange {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.ordered()
+}
+
+func (h *ExchangeHistory) ordered() []Exchange {
+	result := make([]Exchange, 0, len(h.exchanges))
+	result = append(result, h.exchanges[h.next:]...)
+	return append(result, h.exchanges[:h.next]...)
+}
@@ -0,0 +1,106 @@
+package awsapigatewayv2handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestResponseCapture(t *testing.T) {
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "Hello "+r.URL.Query().Get("name"))
+	}))
+	lh.Capture = &ResponseCapture{}
+
+	if _, ok := lh.Capture.Last(); ok {
+		t.Fatalf("expected no response to be captured before Handle is called")
+	}
+	var expected events.APIGatewayV2HTTPResponse
+	for _, name := range []string{"first", "second"} {
+		var err error
+		expected, err = lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+			RawPath:        "/path",
+			RawQueryString: "name=" + name,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	actual, ok := lh.Capture.Last()
+	if !ok {
+		t.Fatalf("expected a response to be captured")
+	}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Errorf("captured response:\n%s", diff)
+	}
+	if actual.Body != "Hello second" {
+		t.Errorf("expected the last response to be captured, got body %q", actual.Body)
+	}
+}
+
+func TestCaptureHistory(t *testing.T) {
+	// The history is supplied, so it's retained without using NewLambdaHandler.
+	lh := LambdaHandler{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "Hello "+r.URL.Path)
+		}),
+		CaptureHistory: &ExchangeHistory{Size: 3},
+	}
+
+	for _, p := range []string{"/1", "/2", "/3", "/4", "/5"} {
+		_, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+			RawPath: p,
+			Body:    "request",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	history := lh.History()
+	var paths []string
+	for _, e := range history {
+		paths = append(paths, e.Path)
+		if e.RequestBody != "" || e.ResponseBody != "" {
+			t.Errorf("%s: expected bodies to be redacted, got %q and %q", e.Path, e.RequestBody, e.ResponseBody)
+		}
+		if e.StatusCode != http.StatusOK {
+			t.Errorf("%s: expected status %d, got %d", e.Path, http.StatusOK, e.StatusCode)
+		}
+	}
+	if diff := cmp.Diff([]string{"/3", "/4", "/5"}, paths); diff != "" {
+		t.Errorf("unexpected history:\n%s", diff)
+	}
+}
+
+func TestCaptureHistoryBodies(t *testing.T) {
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "response")
+	}))
+	lh.CaptureHistory = &ExchangeHistory{Size: 1}
+	lh.CaptureHistoryBodies = true
+
+	_, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+		RawPath: "/path",
+		Body:    "request",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	history := lh.History()
+	if len(history) != 1 {
+		t.Fatalf("expected 1 exchange, got %d", len(history))
+	}
+	if history[0].RequestBody != "request" {
+		t.Errorf("expected request body %q, got %q", "request", history[0].RequestBody)
+	}
+	if history[0].ResponseBody != "response" {
+		t.Errorf("expected response body %q, got %q", "response", history[0].ResponseBody)
+	}
+}
@@ -0,0 +1,90 @@
+package awsapigatewayv2handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var defaultCompressibleContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+func (lh LambdaHandler) compressResponse(r *http.Request, w *responseWriter) {
+	if !lh.CompressResponses || w.body.Len() == 0 || !bodyAllowedForStatus(w.statusCode) {
+		return
+	}
+	// Don't compress responses that the handler has already encoded.
+	if isEncoded(w.result.Get("Content-Encoding")) {
+		return
+	}
+	contentTypes := lh.CompressibleContentTypes
+	if contentTypes == nil {
+		contentTypes = defaultCompressibleContentTypes
+	}
+	if !matchesMediaType(w.result.Get("Content-Type"), contentTypes) {
+		return
+	}
+	w.result.Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		return
+	}
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	if _, err := gw.Write(w.body.Bytes()); err != nil {
+		lh.logError(fmt.Errorf("failed to compress response: %w", err))
+		return
+	}
+	if err := gw.Close(); err != nil {
+		lh.logError(fmt.Errorf("failed to compress response: %w", err))
+		return
+	}
+	w.body = compressed
+	w.result.Set("Content-Encoding", "gzip")
+	w.result.Del("Content-Length")
+}
+
+// matchesMediaType returns true if the media type of the contentType, ignoring any
+// parameters, matches one of the patterns. Patterns may use a wildcard subtype, e.g. "text/*".
+func matchesMediaType(contentType string, patterns []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+		if mediaType == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func acceptsGzip(acceptEncoding string) bool {
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		_, q, hasQ := strings.Cut(strings.ReplaceAll(params, " ", ""), "q=")
+		if !hasQ {
+			return true
+		}
+		if v, err := strconv.ParseFloat(q, 64); err == nil && v > 0 {
+			return true
+		}
+	}
+	return false
+}
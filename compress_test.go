@@ -0,0 +1,160 @@
+package awsapigatewayv2handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestCompressibleContentTypes(t *testing.T) {
+	body := strings.Repeat("compressible ", 100)
+	tests := []struct {
+		name                     string
+		contentType              string
+		compressibleContentTypes []string
+		acceptEncoding           string
+		expectCompressed         bool
+	}{
+		{
+			name:             "JSON is compressed by default",
+			contentType:      "application/json",
+			acceptEncoding:   "gzip, deflate, br",
+			expectCompressed: true,
+		},
+		{
+			name:             "text with a charset is compressed by default",
+			contentType:      "text/html; charset=utf-8",
+			acceptEncoding:   "gzip",
+			expectCompressed: true,
+		},
+		{
+			name:             "images are not compressed by default",
+			contentType:      "image/png",
+			acceptEncoding:   "gzip",
+			expectCompressed: false,
+		},
+		{
+			name:             "responses are not compressed if the client doesn't accept gzip",
+			contentType:      "application/json",
+			acceptEncoding:   "br",
+			expectCompressed: false,
+		},
+		{
+			name:             "responses are not compressed if the client rejects gzip",
+			contentType:      "application/json",
+			acceptEncoding:   "gzip;q=0",
+			expectCompressed: false,
+		},
+		{
+			name:                     "images are not compressed when not in the configured list",
+			contentType:              "image/jpeg",
+			compressibleContentTypes: []string{"application/json"},
+			acceptEncoding:           "gzip",
+			expectCompressed:         false,
+		},
+		{
+			name:                     "JSON is compressed when in the configured list",
+			contentType:              "application/json",
+			compressibleContentTypes: []string{"application/json"},
+			acceptEncoding:           "gzip",
+			expectCompressed:         true,
+		},
+		{
+			name:                     "text is not compressed when not in the configured list",
+			contentType:              "text/plain",
+			compressibleContentTypes: []string{"application/json"},
+			acceptEncoding:           "gzip",
+			expectCompressed:         false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", test.contentType)
+				io.WriteString(w, body)
+			}))
+			lh.CompressResponses = true
+			lh.CompressibleContentTypes = test.compressibleContentTypes
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				Headers: map[string]string{
+					"Accept-Encoding": test.acceptEncoding,
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			contentEncoding := http.Header(resp.MultiValueHeaders).Get("Content-Encoding")
+			if !test.expectCompressed {
+				if contentEncoding != "" {
+					t.Errorf("expected no Content-Encoding, got %q", contentEncoding)
+				}
+				return
+			}
+			if contentEncoding != "gzip" {
+				t.Fatalf("expected gzip Content-Encoding, got %q", contentEncoding)
+			}
+			if !resp.IsBase64Encoded {
+				t.Fatalf("expected compressed body to be base64 encoded")
+			}
+			compressed, err := base64.StdEncoding.DecodeString(resp.Body)
+			if err != nil {
+				t.Fatalf("failed to decode body: %v", err)
+			}
+			gr, err := gzip.NewReader(bytes.NewReader(compressed))
+			if err != nil {
+				t.Fatalf("failed to read gzipped body: %v", err)
+			}
+			decompressed, err := ioutil.ReadAll(gr)
+			if err != nil {
+				t.Fatalf("failed to decompress body: %v", err)
+			}
+			if string(decompressed) != body {
+				t.Errorf("decompressed body did not match the original")
+			}
+		})
+	}
+}
+
+func TestCompressionSkipsEncodedResponses(t *testing.T) {
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	io.WriteString(gw, "Hello, World")
+	if err := gw.Close(); err != nil {
+		t.Fatalf("failed to gzip test data: %v", err)
+	}
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+	lh.CompressResponses = true
+
+	resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+		RawPath: "/path",
+		Headers: map[string]string{
+			"Accept-Encoding": "gzip",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	body, err := base64.StdEncoding.DecodeString(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if !bytes.Equal(body, compressed.Bytes()) {
+		t.Errorf("expected the pre-compressed body to be passed through unmodified")
+	}
+}
@@ -0,0 +1,295 @@
+package awsapigatewayv2handler
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+type contextKey int
+
+const (
+	eventContextKey contextKey = iota
+	correlationIDContextKey
+	requestIDContextKey
+	connectionIDContextKey
+	bodyHashContextKey
+	v1EventContextKey
+	albEventContextKey
+	webSocketEventContextKey
+)
+
+func withEvent(ctx context.Context, e events.APIGatewayV2HTTPRequest) context.Context {
+	return context.WithValue(ctx, eventContextKey, e)
+}
+
+// EventFromContext returns the API Gateway V2 event that the request was created from, e.g. to
+// read the authorizer claims in RequestContext.Authorizer.JWT.Claims. ok is false if the
+// request was created from another type of event, see V1EventFromContext, ALBEventFromContext
+// and WebSocketEventFromContext.
+func EventFromContext(ctx context.Context) (e events.APIGatewayV2HTTPRequest, ok bool) {
+	e, ok = ctx.Value(eventContextKey).(events.APIGatewayV2HTTPRequest)
+	return
+}
+
+func withV1Event(ctx context.Context, e events.APIGatewayProxyRequest) context.Context {
+	return context.WithValue(ctx, v1EventContextKey, e)
+}
+
+// V1EventFromContext returns the API Gateway V1 event that the request was created from by
+// HandleV1. For WebSocket events, it's the V1 event that the WebSocket event was converted to.
+func V1EventFromContext(ctx context.Context) (e events.APIGatewayProxyRequest, ok bool) {
+	e, ok = ctx.Value(v1EventContextKey).(events.APIGatewayProxyRequest)
+	return
+}
+
+func withALBEvent(ctx context.Context, e events.ALBTargetGroupRequest) context.Context {
+	return context.WithValue(ctx, albEventContextKey, e)
+}
+
+// ALBEventFromContext returns the Application Load Balancer event that the request was created
+// from by HandleALB.
+func ALBEventFromContext(ctx context.Context) (e events.ALBTargetGroupRequest, ok bool) {
+	e, ok = ctx.Value(albEventContextKey).(events.ALBTargetGroupRequest)
+	return
+}
+
+func withWebSocketEvent(ctx context.Context, e events.APIGatewayWebsocketProxyRequest) context.Context {
+	return context.WithValue(ctx, webSocketEventContextKey, e)
+}
+
+// WebSocketEventFromContext returns the API Gateway WebSocket event that the request was
+// created from by HandleWebSocket.
+func WebSocketEventFromContext(ctx context.Context) (e events.APIGatewayWebsocketProxyRequest, ok bool) {
+	e, ok = ctx.Value(webSocketEventContextKey).(events.APIGatewayWebsocketProxyRequest)
+	return
+}
+
+// RawPathFrom returns the path exactly as it was delivered by API Gateway,
+// before any normalization was applied to r.URL.Path.
+func RawPathFrom(ctx context.Context) string {
+	e, _ := EventFromContext(ctx)
+	return e.RawPath
+}
+
+// DeclaredContentLengthFrom returns the Content-Length header sent in the API Gateway event.
+// This may differ from the length of the request body, which is used for r.ContentLength.
+func DeclaredContentLengthFrom(ctx context.Context) (length int64, ok bool) {
+	e, ok := EventFromContext(ctx)
+	if !ok {
+		return 0, false
+	}
+	v, ok := getEventHeader(e, "Content-Length")
+	if !ok {
+		return 0, false
+	}
+	length, err := strconv.ParseInt(v, 10, 64)
+	return length, err == nil
+}
+
+// RequestProtocol returns the protocol used by the client to connect to API Gateway,
+// e.g. "HTTP/1.1" or "HTTP/2".
+func RequestProtocol(ctx context.Context) string {
+	e, _ := EventFromContext(ctx)
+	return e.RequestContext.HTTP.Protocol
+}
+
+func withCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDContextKey, id)
+}
+
+// CorrelationIDFrom returns the correlation ID of the request, if the CorrelationHeader
+// option is enabled.
+func CorrelationIDFrom(ctx context.Context) (id string, ok bool) {
+	id, ok = ctx.Value(correlationIDContextKey).(string)
+	return
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey, id)
+}
+
+// RequestIDFromContext returns the API Gateway request ID from the event's RequestContext.
+func RequestIDFromContext(ctx context.Context) (id string, ok bool) {
+	id, ok = ctx.Value(requestIDContextKey).(string)
+	return
+}
+
+// bodyHash computes the hash of the request body when it's first requested.
+type bodyHash struct {
+	once            sync.Once
+	body            string
+	isBase64Encoded bool
+	hash            string
+	ok              bool
+}
+
+func withBodyHash(ctx context.Context, body string, isBase64Encoded bool) context.Context {
+	return context.WithValue(ctx, bodyHashContextKey, &bodyHash{body: body, isBase64Encoded: isBase64Encoded})
+}
+
+// RequestBodyHashFrom returns the hex encoded SHA-256 hash of the decoded request body. The hash
+// is computed from the event on the first call, so the request body can still be read.
+func RequestBodyHashFrom(ctx context.Context) (hash string, ok bool) {
+	h, ok := ctx.Value(bodyHashContextKey).(*bodyHash)
+	if !ok {
+		return "", false
+	}
+	h.once.Do(func() {
+		var body []byte
+		if h.isBase64Encoded {
+			enc, _, err := base64EncodingOf(h.body)
+			if err != nil {
+				return
+			}
+			if body, err = enc.DecodeString(h.body); err != nil {
+				return
+			}
+		} else {
+			body = []byte(h.body)
+		}
+		sum := sha256.Sum256(body)
+		h.hash, h.ok = hex.EncodeToString(sum[:]), true
+	})
+	return h.hash, h.ok
+}
+
+// newCorrelationID returns a random (version 4) UUID.
+func newCorrelationID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic("failed to read random data: " + err.Error())
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// ExtendedRequestIDFrom returns API Gateway's extended request ID, from the event's
+// x-amz-apigw-id header, or the RequestContext of V1 and WebSocket events. It's distinct from
+// the request ID in the event's RequestContext.
+func ExtendedRequestIDFrom(ctx context.Context) (id string, ok bool) {
+	if e, ok := EventFromContext(ctx); ok {
+		return getEventHeader(e, "X-Amz-Apigw-Id")
+	}
+	if e, ok := V1EventFromContext(ctx); ok {
+		if e.RequestContext.ExtendedRequestID != "" {
+			return e.RequestContext.ExtendedRequestID, true
+		}
+		if values := getHeaderValues(e.Headers, e.MultiValueHeaders, "X-Amz-Apigw-Id"); len(values) > 0 {
+			return values[0], true
+		}
+	}
+	return "", false
+}
+
+// getEventHeader returns the value of the event header with the canonical name.
+func getEventHeader(e events.APIGatewayV2HTTPRequest, name string) (value string, ok bool) {
+	for k, v := range e.Headers {
+		if http.CanonicalHeaderKey(k) == name {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// getHeaderValues returns the values of the V1 or ALB event header with the canonical name. The
+// multi-value headers are used if present.
+func getHeaderValues(headers map[string]string, multiValueHeaders map[string][]string, name string) (values []string) {
+	if len(multiValueHeaders) > 0 {
+		for k, v := range multiValueHeaders {
+			if http.CanonicalHeaderKey(k) == name {
+				values = append(values, v...)
+			}
+		}
+		return values
+	}
+	for k, v := range headers {
+		if http.CanonicalHeaderKey(k) == name {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// getHeaderFunc returns a function that returns the first value of the V1 or ALB event header
+// with the name.
+func getHeaderFunc(headers map[string]string, multiValueHeaders map[string][]string) func(name string) string {
+	return func(name string) string {
+		if values := getHeaderValues(headers, multiValueHeaders, http.CanonicalHeaderKey(name)); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+}
+
+// ClaimsFromContext returns the claims of the JWT validated by the route's JWT authorizer. ok
+// is false if the route doesn't have a JWT authorizer, or the request wasn't created from an
+// API Gateway V2 event. For V1 events, the claims are in RequestContext.Authorizer, see
+// V1EventFromContext.
+func ClaimsFromContext(ctx context.Context) (claims map[string]string, ok bool) {
+	e, ok := EventFromContext(ctx)
+	if !ok || e.RequestContext.Authorizer == nil || e.RequestContext.Authorizer.JWT == nil {
+		return nil, false
+	}
+	return e.RequestContext.Authorizer.JWT.Claims, true
+}
+
+// ScopesFromContext returns the scopes of the JWT validated by the route's JWT authorizer,
+// falling back to the space separated "scope" claim. ok is false if the route doesn't have a JWT
+// authorizer, or the request wasn't created from an API Gateway V2 event.
+func ScopesFromContext(ctx context.Context) (scopes []string, ok bool) {
+	e, ok := EventFromContext(ctx)
+	if !ok || e.RequestContext.Authorizer == nil || e.RequestContext.Authorizer.JWT == nil {
+		return nil, false
+	}
+	jwt := e.RequestContext.Authorizer.JWT
+	if len(jwt.Scopes) > 0 {
+		return jwt.Scopes, true
+	}
+	return strings.Fields(jwt.Claims["scope"]), true
+}
+
+// AuthorizerContextFromContext returns the context returned by the route's Lambda authorizer.
+// ok is false if the route doesn't have a Lambda authorizer, or the request wasn't created from
+// an API Gateway V2 event. For V1 events, the context is in RequestContext.Authorizer, see
+// V1EventFromContext.
+func AuthorizerContextFromContext(ctx context.Context) (authorizerContext map[string]interface{}, ok bool) {
+	e, ok := EventFromContext(ctx)
+	if !ok || e.RequestContext.Authorizer == nil || e.RequestContext.Authorizer.Lambda == nil {
+		return nil, false
+	}
+	return e.RequestContext.Authorizer.Lambda, true
+}
+
+// RawCookiesFrom returns the cookies of the event, exactly as they were received, e.g.
+// "name=value". For V1 and ALB events, the cookies are split from the Cookie header. It returns
+// an empty slice if the event doesn't contain any cookies.
+func RawCookiesFrom(ctx context.Context) []string {
+	if e, ok := EventFromContext(ctx); ok && e.Cookies != nil {
+		return e.Cookies
+	}
+	var header []string
+	if e, ok := V1EventFromContext(ctx); ok {
+		header = getHeaderValues(e.Headers, e.MultiValueHeaders, "Cookie")
+	} else if e, ok := ALBEventFromContext(ctx); ok {
+		header = getHeaderValues(e.Headers, e.MultiValueHeaders, "Cookie")
+	}
+	cookies := []string{}
+	for _, v := range header {
+		for _, c := range strings.Split(v, ";") {
+			if c = strings.TrimSpace(c); c != "" {
+				cookies = append(cookies, c)
+			}
+		}
+	}
+	return cookies
+}
@@ -0,0 +1,545 @@
+package awsapigatewayv2handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRawPathFrom(t *testing.T) {
+	var actual string
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actual = RawPathFrom(r.Context())
+	}))
+
+	_, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+		RawPath: "/prod/a%2Fb/c%20d",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if actual != "/prod/a%2Fb/c%20d" {
+		t.Errorf("expected raw path %q, got %q", "/prod/a%2Fb/c%20d", actual)
+	}
+}
+
+func TestRawPathFromWithoutEvent(t *testing.T) {
+	if actual := RawPathFrom(context.Background()); actual != "" {
+		t.Errorf("expected empty raw path, got %q", actual)
+	}
+}
+
+func TestDeclaredContentLengthFrom(t *testing.T) {
+	var declared, actual int64
+	var declaredOK bool
+	var header string
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		declared, declaredOK = DeclaredContentLengthFrom(r.Context())
+		actual = r.ContentLength
+		header = r.Header.Get("Content-Length")
+	}))
+
+	_, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+		RawPath: "/path",
+		Body:    "12345",
+		Headers: map[string]string{
+			"content-length": "10",
+		},
+		RequestContext: events.APIGatewayV2HTTPRequestContext{
+			HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+				Method: "POST",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !declaredOK || declared != 10 {
+		t.Errorf("expected declared length 10, got %d (ok=%v)", declared, declaredOK)
+	}
+	if actual != 5 {
+		t.Errorf("expected r.ContentLength 5, got %d", actual)
+	}
+	if header != "5" {
+		t.Errorf("expected Content-Length header %q, got %q", "5", header)
+	}
+}
+
+func TestRequestProtocol(t *testing.T) {
+	var actual string
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actual = RequestProtocol(r.Context())
+	}))
+
+	_, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+		RawPath: "/path",
+		RequestContext: events.APIGatewayV2HTTPRequestContext{
+			HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+				Protocol: "HTTP/2",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if actual != "HTTP/2" {
+		t.Errorf("expected protocol %q, got %q", "HTTP/2", actual)
+	}
+}
+
+func TestCorrelationID(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		expected string
+	}{
+		{
+			name: "echoed from the request",
+			headers: map[string]string{
+				"x-correlation-id": "abc-123",
+			},
+			expected: "abc-123",
+		},
+		{
+			name: "generated when missing",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var fromContext string
+			var ok bool
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fromContext, ok = CorrelationIDFrom(r.Context())
+			}))
+			lh.CorrelationHeader = "X-Correlation-Id"
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				Headers: test.headers,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			fromResponse := http.Header(resp.MultiValueHeaders).Get("X-Correlation-Id")
+			if !ok || fromContext == "" {
+				t.Fatalf("expected a correlation ID in the context")
+			}
+			if fromResponse != fromContext {
+				t.Errorf("expected response header %q to match context value %q", fromResponse, fromContext)
+			}
+			if test.expected != "" && fromContext != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, fromContext)
+			}
+			if test.expected == "" && len(fromContext) != 36 {
+				t.Errorf("expected a generated UUID, got %q", fromContext)
+			}
+		})
+	}
+}
+
+func TestExtendedRequestIDFrom(t *testing.T) {
+	var requestID, extendedRequestID string
+	var ok bool
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e, _ := EventFromContext(r.Context())
+		requestID = e.RequestContext.RequestID
+		extendedRequestID, ok = ExtendedRequestIDFrom(r.Context())
+	}))
+
+	_, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+		RawPath: "/path",
+		Headers: map[string]string{
+			"x-amz-apigw-id": "Ab1CdEFGHIJKLMn=",
+		},
+		RequestContext: events.APIGatewayV2HTTPRequestContext{
+			RequestID: "c6af9ac6-7b61-11e6-9a41-93e8deadbeef",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !ok || extendedRequestID != "Ab1CdEFGHIJKLMn=" {
+		t.Errorf("expected extended request ID %q, got %q (ok=%v)", "Ab1CdEFGHIJKLMn=", extendedRequestID, ok)
+	}
+	if requestID != "c6af9ac6-7b61-11e6-9a41-93e8deadbeef" {
+		t.Errorf("expected the request ID to be unchanged, got %q", requestID)
+	}
+}
+
+func TestExtendedRequestIDFromMissing(t *testing.T) {
+	ctx := withEvent(context.Background(), events.APIGatewayV2HTTPRequest{})
+	if _, ok := ExtendedRequestIDFrom(ctx); ok {
+		t.Error("expected ok to be false when the header is missing")
+	}
+}
+
+func TestEventFromContext(t *testing.T) {
+	var actual events.APIGatewayV2HTTPRequest
+	var ok bool
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actual, ok = EventFromContext(r.Context())
+	}))
+
+	_, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+		RawPath: "/path",
+		RequestContext: events.APIGatewayV2HTTPRequestContext{
+			Authorizer: &events.APIGatewayV2HTTPRequestContextAuthorizerDescription{
+				JWT: &events.APIGatewayV2HTTPRequestContextAuthorizerJWTDescription{
+					Claims: map[string]string{"sub": "user"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !ok {
+		t.Fatalf("expected the event to be in the context")
+	}
+	if actual.RequestContext.Authorizer.JWT.Claims["sub"] != "user" {
+		t.Errorf("expected claim %q, got %q", "user", actual.RequestContext.Authorizer.JWT.Claims["sub"])
+	}
+	if _, ok := EventFromContext(context.Background()); ok {
+		t.Errorf("expected no event in an empty context")
+	}
+}
+
+func TestRequestIDFromContext(t *testing.T) {
+	tests := []struct {
+		name           string
+		handlerHeader  string
+		expectedHeader string
+	}{
+		{
+			name:           "added to the response",
+			expectedHeader: "c6af9ac6-7b61-11e6-9a41-93e8deadbeef",
+		},
+		{
+			name:           "handler value is not overwritten",
+			handlerHeader:  "custom",
+			expectedHeader: "custom",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var actual string
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				actual, _ = RequestIDFromContext(r.Context())
+				if test.handlerHeader != "" {
+					w.Header().Set("X-Amzn-RequestId", test.handlerHeader)
+				}
+			}))
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				RequestContext: events.APIGatewayV2HTTPRequestContext{
+					RequestID: "c6af9ac6-7b61-11e6-9a41-93e8deadbeef",
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if actual != "c6af9ac6-7b61-11e6-9a41-93e8deadbeef" {
+				t.Errorf("expected request ID %q, got %q", "c6af9ac6-7b61-11e6-9a41-93e8deadbeef", actual)
+			}
+			if header := http.Header(resp.MultiValueHeaders).Get("X-Amzn-RequestId"); header != test.expectedHeader {
+				t.Errorf("expected header %q, got %q", test.expectedHeader, header)
+			}
+		})
+	}
+}
+
+func TestRequestBodyHashFrom(t *testing.T) {
+	tests := []struct {
+		name            string
+		body            string
+		isBase64Encoded bool
+	}{
+		{
+			name: "text body",
+			body: `{"name":"value"}`,
+		},
+		{
+			name:            "base64 encoded body",
+			body:            base64.StdEncoding.EncodeToString([]byte(`{"name":"value"}`)),
+			isBase64Encoded: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var actual, actualBody string
+			var ok bool
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				actual, ok = RequestBodyHashFrom(r.Context())
+				body, _ := io.ReadAll(r.Body)
+				actualBody = string(body)
+			}))
+
+			_, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath:         "/path",
+				Body:            test.body,
+				IsBase64Encoded: test.isBase64Encoded,
+				RequestContext: events.APIGatewayV2HTTPRequestContext{
+					HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+						Method: http.MethodPost,
+					},
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			sum := sha256.Sum256([]byte(`{"name":"value"}`))
+			expected := hex.EncodeToString(sum[:])
+			if !ok || actual != expected {
+				t.Errorf("expected hash %q, got %q", expected, actual)
+			}
+			if actualBody != `{"name":"value"}` {
+				t.Errorf("expected the body to be readable, got %q", actualBody)
+			}
+		})
+	}
+}
+
+func TestClaimsFromContext(t *testing.T) {
+	tests := []struct {
+		name           string
+		authorizer     *events.APIGatewayV2HTTPRequestContextAuthorizerDescription
+		expectedClaims map[string]string
+		expectedScopes []string
+		expectedOK     bool
+	}{
+		{
+			name: "scope claim",
+			authorizer: &events.APIGatewayV2HTTPRequestContextAuthorizerDescription{
+				JWT: &events.APIGatewayV2HTTPRequestContextAuthorizerJWTDescription{
+					Claims: map[string]string{"sub": "user", "scope": "read write"},
+				},
+			},
+			expectedClaims: map[string]string{"sub": "user", "scope": "read write"},
+			expectedScopes: []string{"read", "write"},
+			expectedOK:     true,
+		},
+		{
+			name: "scopes field",
+			authorizer: &events.APIGatewayV2HTTPRequestContextAuthorizerDescription{
+				JWT: &events.APIGatewayV2HTTPRequestContextAuthorizerJWTDescription{
+					Claims: map[string]string{"sub": "user"},
+					Scopes: []string{"admin"},
+				},
+			},
+			expectedClaims: map[string]string{"sub": "user"},
+			expectedScopes: []string{"admin"},
+			expectedOK:     true,
+		},
+		{
+			name: "no authorizer",
+		},
+		{
+			name: "IAM authorizer",
+			authorizer: &events.APIGatewayV2HTTPRequestContextAuthorizerDescription{
+				IAM: &events.APIGatewayV2HTTPRequestContextAuthorizerIAMDescription{},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var claims map[string]string
+			var scopes []string
+			var claimsOK, scopesOK bool
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				claims, claimsOK = ClaimsFromContext(r.Context())
+				scopes, scopesOK = ScopesFromContext(r.Context())
+			}))
+
+			_, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				RequestContext: events.APIGatewayV2HTTPRequestContext{
+					Authorizer: test.authorizer,
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if claimsOK != test.expectedOK || scopesOK != test.expectedOK {
+				t.Errorf("expected ok to be %v, got %v and %v", test.expectedOK, claimsOK, scopesOK)
+			}
+			if diff := cmp.Diff(test.expectedClaims, claims); diff != "" {
+				t.Errorf("unexpected claims: %s", diff)
+			}
+			if diff := cmp.Diff(test.expectedScopes, scopes); diff != "" {
+				t.Errorf("unexpected scopes: %s", diff)
+			}
+		})
+	}
+}
+
+func TestAuthorizerContextFromContext(t *testing.T) {
+	var authorizerContext map[string]interface{}
+	var ok, claimsOK bool
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizerContext, ok = AuthorizerContextFromContext(r.Context())
+		_, claimsOK = ClaimsFromContext(r.Context())
+	}))
+	payload := `{
+		"version": "2.0",
+		"rawPath": "/path",
+		"requestContext": {
+			"authorizer": {
+				"lambda": {"tenantId": "tenant-1", "admin": true}
+			},
+			"http": {"method": "GET", "path": "/path"}
+		}
+	}`
+
+	_, err := lh.Invoke(context.Background(), []byte(payload))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !ok {
+		t.Fatalf("expected the authorizer context to be found")
+	}
+	if diff := cmp.Diff(map[string]interface{}{"tenantId": "tenant-1", "admin": true}, authorizerContext); diff != "" {
+		t.Errorf("unexpected authorizer context: %s", diff)
+	}
+	if claimsOK {
+		t.Errorf("expected no JWT claims")
+	}
+	if _, ok := AuthorizerContextFromContext(context.Background()); ok {
+		t.Errorf("expected no authorizer context in an empty context")
+	}
+}
+
+func TestRawCookiesFrom(t *testing.T) {
+	tests := []struct {
+		name     string
+		cookies  []string
+		expected []string
+	}{
+		{
+			name:     "cookies",
+			cookies:  []string{"a=1", "b=\"quoted value\"", "invalid cookie"},
+			expected: []string{"a=1", "b=\"quoted value\"", "invalid cookie"},
+		},
+		{
+			name:     "no cookies",
+			expected: []string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var actual []string
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				actual = RawCookiesFrom(r.Context())
+			}))
+
+			_, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				Cookies: test.cookies,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if diff := cmp.Diff(test.expected, actual); diff != "" {
+				t.Errorf("unexpected cookies: %s", diff)
+			}
+			if actual == nil {
+				t.Errorf("expected an empty slice, not nil")
+			}
+		})
+	}
+	if actual := RawCookiesFrom(context.Background()); actual == nil || len(actual) != 0 {
+		t.Errorf("expected an empty slice without an event, got %#v", actual)
+	}
+}
+
+func TestEventFromContextFormats(t *testing.T) {
+	var v1, alb, webSocket, v2 bool
+	var cookies []string
+	var extendedRequestID string
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, v1 = V1EventFromContext(r.Context())
+		_, alb = ALBEventFromContext(r.Context())
+		_, webSocket = WebSocketEventFromContext(r.Context())
+		_, v2 = EventFromContext(r.Context())
+		cookies = RawCookiesFrom(r.Context())
+		extendedRequestID, _ = ExtendedRequestIDFrom(r.Context())
+	}))
+
+	t.Run("V1", func(t *testing.T) {
+		_, err := lh.HandleV1(context.Background(), events.APIGatewayProxyRequest{
+			HTTPMethod: http.MethodGet,
+			Path:       "/path",
+			MultiValueHeaders: map[string][]string{
+				"cookie": {"a=1; b=2", "c=3"},
+			},
+			RequestContext: events.APIGatewayProxyRequestContext{
+				ExtendedRequestID: "Ab1CdEFGHIJKLMn=",
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !v1 || alb || webSocket || v2 {
+			t.Errorf("expected only the V1 event, got V1=%v, ALB=%v, WebSocket=%v, V2=%v", v1, alb, webSocket, v2)
+		}
+		if diff := cmp.Diff([]string{"a=1", "b=2", "c=3"}, cookies); diff != "" {
+			t.Errorf("unexpected cookies: %s", diff)
+		}
+		if extendedRequestID != "Ab1CdEFGHIJKLMn=" {
+			t.Errorf("expected extended request ID %q, got %q", "Ab1CdEFGHIJKLMn=", extendedRequestID)
+		}
+	})
+	t.Run("ALB", func(t *testing.T) {
+		_, err := lh.HandleALB(context.Background(), events.ALBTargetGroupRequest{
+			HTTPMethod: http.MethodGet,
+			Path:       "/path",
+			Headers: map[string]string{
+				"cookie": "a=1; b=2",
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if v1 || !alb || webSocket || v2 {
+			t.Errorf("expected only the ALB event, got V1=%v, ALB=%v, WebSocket=%v, V2=%v", v1, alb, webSocket, v2)
+		}
+		if diff := cmp.Diff([]string{"a=1", "b=2"}, cookies); diff != "" {
+			t.Errorf("unexpected cookies: %s", diff)
+		}
+	})
+	t.Run("WebSocket", func(t *testing.T) {
+		_, err := lh.HandleWebSocket(context.Background(), events.APIGatewayWebsocketProxyRequest{
+			RequestContext: events.APIGatewayWebsocketProxyRequestContext{
+				RouteKey:          "$default",
+				ExtendedRequestID: "Ab1CdEFGHIJKLMn=",
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !v1 || alb || !webSocket || v2 {
+			t.Errorf("expected the WebSocket and V1 events, got V1=%v, ALB=%v, WebSocket=%v, V2=%v", v1, alb, webSocket, v2)
+		}
+		if extendedRequestID != "Ab1CdEFGHIJKLMn=" {
+			t.Errorf("expected extended request ID %q, got %q", "Ab1CdEFGHIJKLMn=", extendedRequestID)
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package awsapigatewayv2handler
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// setForwarded sets the request's RemoteAddr and TLS state from the X-Forwarded-For and
+// X-Forwarded-Proto headers added by API Gateway, falling back to the RFC 7239 Forwarded header.
+func setForwarded(r *http.Request) {
+	forwarded := parseForwarded(r.Header.Get("Forwarded"))
+	addr := lastValue(r.Header.Get("X-Forwarded-For"))
+	if addr == "" {
+		addr = forwarded["for"]
+	}
+	r.RemoteAddr = withPort(addr)
+	if strings.EqualFold(forwardedProto(r.Header), "https") {
+		r.TLS = &tls.ConnectionState{}
+	}
+}
+
+// forwardedProto returns the protocol used by the client to connect to API Gateway.
+func forwardedProto(h http.Header) string {
+	proto := lastValue(h.Get("X-Forwarded-Proto"))
+	if proto == "" {
+		proto = parseForwarded(h.Get("Forwarded"))["proto"]
+	}
+	return proto
+}
+
+// lastValue returns the last value of a comma separated list, which is the value added
+// by the closest proxy.
+func lastValue(list string) string {
+	values := strings.Split(list, ",")
+	return strings.TrimSpace(values[len(values)-1])
+}
+
+// parseForwarded returns the parameters of the last element of a Forwarded header, e.g.
+// "for=192.0.2.60;proto=http, for=198.51.100.17;proto=https".
+func parseForwarded(header string) map[string]string {
+	params := make(map[string]string)
+	if header == "" {
+		return params
+	}
+	for _, pair := range strings.Split(lastValue(header), ";") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			continue
+		}
+		params[strings.ToLower(k)] = strings.Trim(v, `"`)
+	}
+	return params
+}
+
+// withPort adds a port of 0 to an address that doesn't have one, since http.Request.RemoteAddr
+// is conventionally "host:port".
+func withPort(addr string) string {
+	if addr == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), "0")
+}
+
+// stripDefaultPort removes the port from the request's host if it's the default port for the
+// scheme, e.g. "example.com:443" becomes "example.com" for https requests.
+func stripDefaultPort(r *http.Request) {
+	var port string
+	switch r.URL.Scheme {
+	case "https":
+		port = ":443"
+	case "http":
+		port = ":80"
+	default:
+		return
+	}
+	r.Host = strings.TrimSuffix(r.Host, port)
+	r.URL.Host = strings.TrimSuffix(r.URL.Host, port)
+}
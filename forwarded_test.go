@@ -0,0 +1,241 @@
+package awsapigatewayv2handler
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	tests := []struct {
+		name               string
+		headers            map[string]string
+		sourceIP           string
+		expectedRemoteAddr string
+		expectedTLS        bool
+	}{
+		{
+			name:               "no headers",
+			expectedRemoteAddr: "",
+			expectedTLS:        false,
+		},
+		{
+			name: "X-Forwarded headers",
+			headers: map[string]string{
+				"x-forwarded-for":   "198.51.100.1, 192.0.2.1",
+				"x-forwarded-proto": "https",
+			},
+			expectedRemoteAddr: "192.0.2.1:0",
+			expectedTLS:        true,
+		},
+		{
+			name: "Forwarded header",
+			headers: map[string]string{
+				"forwarded": "for=192.0.2.60;proto=https;by=203.0.113.43",
+			},
+			expectedRemoteAddr: "192.0.2.60:0",
+			expectedTLS:        true,
+		},
+		{
+			name: "Forwarded header over http",
+			headers: map[string]string{
+				"forwarded": "for=192.0.2.60;proto=http",
+			},
+			expectedRemoteAddr: "192.0.2.60:0",
+			expectedTLS:        false,
+		},
+		{
+			name: "Forwarded header with multiple elements and a quoted IPv6 address",
+			headers: map[string]string{
+				"forwarded": `for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711";proto=https`,
+			},
+			expectedRemoteAddr: "[2001:db8:cafe::17]:4711",
+			expectedTLS:        true,
+		},
+		{
+			name: "X-Forwarded headers take precedence",
+			headers: map[string]string{
+				"x-forwarded-for":   "192.0.2.1",
+				"x-forwarded-proto": "http",
+				"forwarded":         "for=192.0.2.60;proto=https",
+			},
+			expectedRemoteAddr: "192.0.2.1:0",
+			expectedTLS:        false,
+		},
+		{
+			name:               "source IP",
+			sourceIP:           "203.0.113.7",
+			expectedRemoteAddr: "203.0.113.7:0",
+		},
+		{
+			name: "source IP takes precedence",
+			headers: map[string]string{
+				"x-forwarded-for": "192.0.2.1",
+			},
+			sourceIP:           "203.0.113.7",
+			expectedRemoteAddr: "203.0.113.7:0",
+		},
+		{
+			name:               "IPv6 source IP",
+			sourceIP:           "2001:db8::1",
+			expectedRemoteAddr: "[2001:db8::1]:0",
+		},
+	}
+	lh := NewLambdaHandler(http.NotFoundHandler())
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := lh.convertLambdaEventToHTTPRequest(events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				Headers: test.headers,
+				RequestContext: events.APIGatewayV2HTTPRequestContext{
+					HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+						SourceIP: test.sourceIP,
+					},
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if r.RemoteAddr != test.expectedRemoteAddr {
+				t.Errorf("expected remote address %q, got %q", test.expectedRemoteAddr, r.RemoteAddr)
+			}
+			if actualTLS := r.TLS != nil; actualTLS != test.expectedTLS {
+				t.Errorf("expected TLS %v, got %v", test.expectedTLS, actualTLS)
+			}
+		})
+	}
+}
+
+func TestHost(t *testing.T) {
+	tests := []struct {
+		name        string
+		headers     map[string]string
+		domainName  string
+		expectedURL string
+	}{
+		{
+			name:        "no host",
+			expectedURL: "/path",
+		},
+		{
+			name:        "domain name",
+			domainName:  "api.example.com",
+			expectedURL: "https://api.example.com/path",
+		},
+		{
+			name: "host header takes precedence",
+			headers: map[string]string{
+				"host": "tenant.example.com",
+			},
+			domainName:  "api.example.com",
+			expectedURL: "https://tenant.example.com/path",
+		},
+		{
+			name: "plain HTTP",
+			headers: map[string]string{
+				"host":              "tenant.example.com",
+				"x-forwarded-proto": "http",
+			},
+			expectedURL: "http://tenant.example.com/path",
+		},
+	}
+	lh := NewLambdaHandler(http.NotFoundHandler())
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := lh.convertLambdaEventToHTTPRequest(events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				Headers: test.headers,
+				RequestContext: events.APIGatewayV2HTTPRequestContext{
+					DomainName: test.domainName,
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if r.URL.String() != test.expectedURL {
+				t.Errorf("expected URL %q, got %q", test.expectedURL, r.URL.String())
+			}
+			if r.Host != r.URL.Host {
+				t.Errorf("expected host %q, got %q", r.URL.Host, r.Host)
+			}
+			if r.Header.Get("Host") != "" {
+				t.Errorf("expected the Host header to be removed")
+			}
+		})
+	}
+}
+
+func TestStripDefaultPort(t *testing.T) {
+	tests := []struct {
+		name         string
+		host         string
+		proto        string
+		expectedHost string
+	}{
+		{
+			name:         "no port",
+			host:         "example.com",
+			expectedHost: "example.com",
+		},
+		{
+			name:         "default https port",
+			host:         "example.com:443",
+			expectedHost: "example.com",
+		},
+		{
+			name:         "default http port",
+			host:         "example.com:80",
+			proto:        "http",
+			expectedHost: "example.com",
+		},
+		{
+			name:         "http port with https",
+			host:         "example.com:80",
+			expectedHost: "example.com:80",
+		},
+		{
+			name:         "non-default port",
+			host:         "example.com:8443",
+			expectedHost: "example.com:8443",
+		},
+		{
+			name:         "IPv6 with the default port",
+			host:         "[::1]:443",
+			expectedHost: "[::1]",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var host, urlHost string
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				host, urlHost = r.Host, r.URL.Host
+			}))
+			lh.StripDefaultPort = true
+
+			headers := map[string]string{
+				"host": test.host,
+			}
+			if test.proto != "" {
+				headers["x-forwarded-proto"] = test.proto
+			}
+			_, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				Headers: headers,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if host != test.expectedHost {
+				t.Errorf("expected host %q, got %q", test.expectedHost, host)
+			}
+			if urlHost != test.expectedHost {
+				t.Errorf("expected URL host %q, got %q", test.expectedHost, urlHost)
+			}
+		})
+	}
+}
@@ -1,8 +1,8 @@
 module github.com/a-h/awsapigatewayv2handler
 
-go 1.17
+go 1.18
 
 require (
-	github.com/aws/aws-lambda-go v1.27.0
+	github.com/aws/aws-lambda-go v1.47.0
 	github.com/google/go-cmp v0.5.6
 )
@@ -1,42 +1,336 @@
 package awsapigatewayv2handler
 
 import (
-	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
-	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 )
 
-func ListenAndServe(h http.Handler) {
+func ListenAndServe(h http.Handler, opts ...Option) {
 	if h == nil {
 		h = http.DefaultServeMux
 	}
-	lambda.StartHandler(NewLambdaHandler(h))
+	lambda.StartHandler(NewLambdaHandler(h, opts...))
 }
 
-func NewLambdaHandler(h http.Handler) LambdaHandler {
-	return LambdaHandler{
-		Handler: h,
+func NewLambdaHandler(h http.Handler, opts ...Option) LambdaHandler {
+	lh := LambdaHandler{
+		Handler:   h,
+		coldStart: &coldStart{},
 	}
+	for _, opt := range opts {
+		opt(&lh)
+	}
+	return lh
 }
 
 type LambdaHandler struct {
 	Handler http.Handler
+	// OnError is called with errors that don't stop a response from being returned, e.g. a
+	// handler writing a body for a status code that doesn't permit one.
+	OnError func(err error)
+	// OnWarning is called with warnings, such as slow requests, which don't indicate that
+	// anything is broken.
+	OnWarning func(err error)
+	// SlowRequestThreshold, if set, logs a warning to OnWarning when a request takes longer
+	// than the threshold to handle.
+	SlowRequestThreshold time.Duration
+	// MaxRequestHeaders is the maximum number of headers allowed in a request. Requests with
+	// more headers are rejected with a 400 status. Zero means no limit.
+	MaxRequestHeaders int
+	// MaxRequestHeaderBytes is the maximum total size of the request's header names and
+	// values. Requests with larger headers are rejected with a 431 status. Zero means no limit.
+	MaxRequestHeaderBytes int
+	// AccessLog, if set, is called after each request has been handled.
+	AccessLog func(entry AccessLogEntry)
+	// Observer, if set, is called with the final status of each invocation, including requests
+	// rejected before the http.Handler is called, and invocations that panic, even if
+	// RecoverPanics is disabled.
+	Observer func(info RequestInfo)
+	// CompressResponses enables gzip compression of responses to clients that accept it.
+	CompressResponses bool
+	// CompressibleContentTypes is the list of media types that are compressed when
+	// CompressResponses is enabled, e.g. "application/json" or "text/*". If nil, a
+	// default list of text, JSON, XML and JavaScript types is used.
+	CompressibleContentTypes []string
+	// RequiredBearerToken, if set, rejects requests with a 401 status unless they have an
+	// "Authorization: Bearer <token>" header that matches.
+	RequiredBearerToken string
+	// RateLimiter, if set, rejects requests that exceed its rate limit with a 429 status.
+	RateLimiter *RateLimiter
+	// AllowedMethods, if set, rejects requests with other methods with a 405 status and an
+	// Allow header listing the allowed methods.
+	AllowedMethods []string
+	// LegacySemicolonQuerySeparator treats semicolons in the query string as parameter
+	// separators, as Go did before version 1.17, e.g. "a=1;b=2" is equivalent to "a=1&b=2".
+	// By default, r.URL.Query() ignores parameters that contain semicolons.
+	LegacySemicolonQuerySeparator bool
+	// StripStagePrefix removes the stage from the start of the path, e.g. "/prod/users" becomes
+	// "/users", for APIs that are invoked using the stage's URL, rather than a custom domain.
+	// The "$default" stage isn't part of the path, so it's never removed.
+	StripStagePrefix bool
+	// BasePath, if set, is removed from the start of the path, e.g. a BasePath of "/api"
+	// changes "/api/users" to "/users". It takes precedence over StripStagePrefix.
+	BasePath string
+	// StripDefaultPort removes the default port for the scheme from r.Host and r.URL.Host,
+	// e.g. "example.com:443" becomes "example.com" for https requests.
+	StripDefaultPort bool
+	// DisableTraceHeader stops the X-Ray trace ID of the invocation, from the _X_AMZN_TRACE_ID
+	// environment variable, being added to requests that don't have an X-Amzn-Trace-Id header.
+	DisableTraceHeader bool
+	// RejectInvalidUTF8Path rejects requests with a 400 status if the decoded path isn't
+	// valid UTF-8.
+	RejectInvalidUTF8Path bool
+	// RequireHTTPS rejects requests with a 403 status if the X-Forwarded-Proto (or
+	// Forwarded) header shows that the client didn't connect to API Gateway over HTTPS.
+	RequireHTTPS bool
+	// AcceptedContentTypes, if set, rejects requests with a body with a 415 status unless
+	// the media type of their Content-Type matches one of the list, e.g. "application/json".
+	AcceptedContentTypes []string
+	// AllowMissingContentType accepts requests with a body but no Content-Type header when
+	// AcceptedContentTypes is set.
+	AllowMissingContentType bool
+	// RequiredAPIKeys, if set, rejects requests with a 403 status unless their X-Api-Key
+	// header is one of the keys with a true value.
+	RequiredAPIKeys map[string]bool
+	// CleanPath collapses repeated slashes and resolves "." and ".." segments in r.URL.Path.
+	// A trailing slash is preserved, and encoded slashes are not treated as separators.
+	CleanPath bool
+	// ErrorHandler, if set, creates the response returned when Invoke can't unmarshal the
+	// event. By default, the error is returned to Lambda.
+	ErrorHandler func(err error) events.APIGatewayV2HTTPResponse
+	// BadRequestResponse, if set, creates the response returned when the event can't be
+	// converted to a HTTP request, e.g. due to a corrupt base64 body. By default, a 400
+	// status is returned.
+	BadRequestResponse func(err error) events.APIGatewayV2HTTPResponse
+	// CacheControl, if set, returns the Cache-Control header to add to responses with the
+	// given status code. Headers set by the handler take precedence, and an empty value
+	// adds no header.
+	CacheControl func(statusCode int) string
+	// Capture, if set, retains the last response returned by Handle or HandleV1. Responses to V1
+	// events are retained in the V2 format.
+	Capture *ResponseCapture
+	// TreatEmptyAsError returns a 500 status if the handler returns without writing a
+	// status code or body, rather than an empty 200 response.
+	TreatEmptyAsError bool
+	// AddDateHeader adds a Date header to responses that don't have one. It's off by default,
+	// because API Gateway adds its own Date header.
+	AddDateHeader bool
+	// CorrelationHeader, if set, is the name of a request header, e.g. "X-Correlation-Id",
+	// that's copied to the response. If the request doesn't have the header, a new ID is
+	// generated. The ID is available to handlers via CorrelationIDFrom.
+	CorrelationHeader string
+	// RecoverPanics recovers from panics in the handler, returning a 500 status instead of
+	// a Lambda error. The panic is logged to OnError.
+	RecoverPanics bool
+	// PanicHandler, if set, writes the response when RecoverPanics is enabled and the handler
+	// panics, in place of PanicResponse. Anything written by the panicking handler is discarded.
+	PanicHandler func(w http.ResponseWriter, r *http.Request, recovered interface{})
+	// Debug includes the panic value and stack trace in the body of the 500 response returned
+	// when a panic is recovered, as JSON, e.g. {"error":"something went wrong","stack":"..."}.
+	// It should not be enabled in production. Debug is new, earlier versions always return a
+	// plain 500 response. Debug is ignored if PanicHandler or PanicResponse is set.
+	Debug bool
+	// PanicResponse, if set, creates the response returned when RecoverPanics is enabled
+	// and the handler panics. By default, a plain 500 status is returned. PanicResponse takes
+	// precedence over Debug, so the stack trace is only returned if PanicResponse includes it.
+	PanicResponse func(recovered interface{}, stack []byte) events.APIGatewayV2HTTPResponse
+	// AllowedStatusCodes, if set, is the list of status codes that the handler may return.
+	// Other status codes are logged to OnError and replaced with a 500 status.
+	AllowedStatusCodes []int
+	// MaxResponseCookies, if set, is the maximum number of cookies in a response. Excess
+	// cookies are discarded and logged to OnError.
+	MaxResponseCookies int
+	// RejectExcessCookies replaces responses with more than MaxResponseCookies cookies with a
+	// 500 status, rather than discarding the excess cookies.
+	RejectExcessCookies bool
+	// WrapErrorBodies replaces the body of 4xx and 5xx responses that are empty, or plain
+	// text, with a JSON error, e.g. {"error":{"status":404,"message":"Not Found"}}. The plain
+	// text is used as the message, falling back to the status text.
+	WrapErrorBodies bool
+	// MaxResponsePayloadSize, if set, is the maximum estimated size of the serialized response,
+	// including the headers and the base64 encoded body. Larger responses are logged to OnError
+	// and replaced with a 500 status. Lambda limits response payloads to 6MB.
+	MaxResponsePayloadSize int
+	// TrimResponseTrailingNewline removes a single trailing newline from JSON response bodies,
+	// such as the one written by json.Encoder.
+	TrimResponseTrailingNewline bool
+	// TextContentTypes is a list of media types, e.g. "application/wasm", that are returned as
+	// text rather than being base64 encoded, in addition to text/* and common application
+	// types such as application/json. Matching is on the media type only,
+	// ignoring parameters such as "; charset=utf-8". Wildcard subtypes, e.g. "text/*", are
+	// supported.
+	TextContentTypes []string
+	// TextTypeFunc, if set, replaces the default text type detection. It's called with the
+	// media type of the response, without parameters, and returns true if the body should be
+	// returned as text rather than being base64 encoded.
+	TextTypeFunc func(mediaType string) bool
+	// SupportedRequestEncodings is the list of request Content-Encodings, e.g. "gzip", that the
+	// handler can decode. Requests with other encodings are logged to OnWarning, or rejected
+	// if RejectUnsupportedRequestEncoding is enabled.
+	SupportedRequestEncodings []string
+	// RejectUnsupportedRequestEncoding rejects requests with a Content-Encoding that isn't in
+	// SupportedRequestEncodings with a 415 status.
+	RejectUnsupportedRequestEncoding bool
+	// RequiredAPIVersionHeader, if set, is the name of a header, e.g. "X-API-Version", that
+	// requests must include. Requests without it are rejected with a 400 status.
+	RequiredAPIVersionHeader string
+	// SupportedAPIVersions, if set, rejects requests with a 400 status unless the value of
+	// the RequiredAPIVersionHeader is in the list.
+	SupportedAPIVersions []string
+	// HonorLambdaDeadline sets a deadline on the request context, DeadlineMargin before the
+	// Lambda deadline, so that handlers can abort slow work and still return a response.
+	HonorLambdaDeadline bool
+	// DeadlineMargin is the time reserved for returning a response when HonorLambdaDeadline
+	// is enabled.
+	DeadlineMargin time.Duration
+	// DeadlineExceededBody is the body of the 504 response returned when the context deadline,
+	// e.g. the Lambda deadline, is exceeded before the handler returns. By default, the status
+	// text is used.
+	DeadlineExceededBody string
+	// AddStageHeader adds an X-Stage header containing the API Gateway stage to responses,
+	// unless the stage is "$default".
+	AddStageHeader bool
+	// AddColdStartHeader adds an X-Cold-Start header to responses, which is "true" for the
+	// first invocation handled, and "false" for later invocations.
+	AddColdStartHeader bool
+	// AddFunctionVersionHeader adds an X-Function-Version header to responses, containing the
+	// qualifier of the invoked function's ARN, i.e. the version, or the alias if the function was
+	// invoked using an alias. It's omitted if the function was invoked without a qualifier.
+	AddFunctionVersionHeader bool
+	// DeprecationWarning, if set, is called with each request. If it returns a message, e.g.
+	// "Deprecated endpoint", a Warning header with code 299 is added to the response, e.g.
+	// `Warning: 299 - "Deprecated endpoint"`.
+	DeprecationWarning func(r *http.Request) string
+	// CaptureHistory, if set, retains recent exchanges, which are returned by History.
+	CaptureHistory *ExchangeHistory
+	// CaptureHistoryBodies includes request and response bodies in the exchanges returned by
+	// History. By default, bodies are redacted.
+	CaptureHistoryBodies bool
+
+	coldStart  *coldStart
+	middleware *middlewareChain
+}
+
+// Use adds middleware that wraps the Handler. Middleware is applied in the order that it's
+// added, so the first middleware is the outermost, and sees the request first.
+//
+// The middleware is stored in the LambdaHandler, so Use must be called before the handler is
+// copied, e.g. before lambda.Start(lh.Handle). The middleware is composed with the Handler once,
+// when the first request is handled.
+func (lh *LambdaHandler) Use(mw ...func(http.Handler) http.Handler) {
+	var existing []func(http.Handler) http.Handler
+	if lh.middleware != nil {
+		existing = lh.middleware.mw
+	}
+	// Copies of the handler made before Use was called keep their own chain.
+	lh.middleware = &middlewareChain{
+		mw: append(existing[:len(existing):len(existing)], mw...),
+	}
+}
+
+// middlewareChain is the middleware added with Use, which is composed with the Handler once.
+type middlewareChain struct {
+	mw   []func(http.Handler) http.Handler
+	once sync.Once
+	h    http.Handler
+}
+
+// handler returns the middleware composed with next, composing it on the first call.
+func (c *middlewareChain) handler(next http.Handler) http.Handler {
+	c.once.Do(func() {
+		c.h = next
+		for i := len(c.mw) - 1; i >= 0; i-- {
+			c.h = c.mw[i](c.h)
+		}
+	})
+	return c.h
+}
+
+// AccessLogEntry contains the details of a handled request.
+type AccessLogEntry struct {
+	Time       time.Time
+	Method     string
+	Path       string
+	StatusCode int
+	// Bytes is the length of the response body, before any base64 encoding.
+	Bytes int
+	// Duration is the total time taken to handle the request, including converting the
+	// event and response.
+	Duration time.Duration
+	// HandlerDuration is the time spent executing the http.Handler.
+	HandlerDuration time.Duration
+	SourceIP        string
+	UserAgent       string
+}
+
+// RequestInfo contains the details of a request passed to the Observer.
+type RequestInfo struct {
+	Method string
+	Path   string
+	// StatusCode is the status code of the response, or 500 if the invocation panicked or
+	// returned an error.
+	StatusCode int
+	// Duration is the time spent handling the invocation.
+	Duration  time.Duration
+	RequestID string
 }
 
 func (lh LambdaHandler) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
+	format := getPayloadFormat(payload)
+	switch format {
+	case payloadFormatV1:
+		var req events.APIGatewayProxyRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return lh.unmarshalError(err, format)
+		}
+		resp, err := lh.HandleV1(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(resp)
+	case payloadFormatALB:
+		var req events.ALBTargetGroupRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return lh.unmarshalError(err, format)
+		}
+		resp, err := lh.HandleALB(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(resp)
+	case payloadFormatWebSocket:
+		var req events.APIGatewayWebsocketProxyRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return lh.unmarshalError(err, format)
+		}
+		resp, err := lh.HandleWebSocket(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(resp)
+	}
 	var req events.APIGatewayV2HTTPRequest
 	err := json.Unmarshal(payload, &req)
 	if err != nil {
-		return nil, err
+		return lh.unmarshalError(err, format)
 	}
 	resp, err := lh.Handle(ctx, req)
 	if err != nil {
@@ -45,66 +339,785 @@ func (lh LambdaHandler) Invoke(ctx context.Context, payload []byte) ([]byte, err
 	return json.Marshal(resp)
 }
 
+// unmarshalError returns the response created by the ErrorHandler, in the payload format of
+// the event, or the error if there's no ErrorHandler.
+func (lh LambdaHandler) unmarshalError(err error, format payloadFormat) ([]byte, error) {
+	if lh.ErrorHandler == nil {
+		return nil, err
+	}
+	resp := lh.ErrorHandler(fmt.Errorf("failed to unmarshal event: %w", err))
+	switch format {
+	case payloadFormatV1, payloadFormatWebSocket:
+		return json.Marshal(convertV2ResponseToV1(resp))
+	case payloadFormatALB:
+		return json.Marshal(lh.convertV2ResponseToALB(resp, false))
+	}
+	return json.Marshal(resp)
+}
+
+// HandleJSON is equivalent to Invoke, for use with custom runtime loops that work with json.RawMessage.
+func (lh LambdaHandler) HandleJSON(ctx context.Context, payload json.RawMessage) (json.RawMessage, error) {
+	return lh.Invoke(ctx, payload)
+}
+
 func (lh LambdaHandler) Handle(ctx context.Context, e events.APIGatewayV2HTTPRequest) (resp events.APIGatewayV2HTTPResponse, err error) {
+	return lh.handle(withEvent(ctx, e), newInvocation(e), func() (*http.Request, error) {
+		return lh.convertLambdaEventToHTTPRequest(e)
+	})
+}
+
+func newInvocation(e events.APIGatewayV2HTTPRequest) invocation {
+	return invocation{
+		method:      e.RequestContext.HTTP.Method,
+		path:        e.RawPath,
+		sourceIP:    e.RequestContext.HTTP.SourceIP,
+		userAgent:   e.RequestContext.HTTP.UserAgent,
+		headerCount: len(e.Headers),
+		headerBytes: getHeaderBytes(e),
+		body:        e.Body,
+		isBase64:    e.IsBase64Encoded,
+		stage:       e.RequestContext.Stage,
+		requestID:   e.RequestContext.RequestID,
+		header: func(name string) string {
+			v, _ := getEventHeader(e, http.CanonicalHeaderKey(name))
+			return v
+		},
+	}
+}
+
+// invocation contains the details of an event that are common to all payload formats.
+type invocation struct {
+	method      string
+	path        string
+	sourceIP    string
+	userAgent   string
+	headerCount int
+	headerBytes int
+	body        string
+	isBase64    bool
+	stage       string
+	requestID   string
+	// header returns the first value of the event's header with the name.
+	header func(name string) string
+	// coldStart is true if this is the first invocation handled.
+	coldStart bool
+}
+
+// handle converts the event to a HTTP request using convert and executes the handler.
+func (lh LambdaHandler) handle(ctx context.Context, inv invocation, convert func() (*http.Request, error)) (resp events.APIGatewayV2HTTPResponse, err error) {
+	start := time.Now()
+	var handlerDuration time.Duration
+	var returned bool
+	if lh.Observer != nil {
+		defer func() {
+			// The invocation panicked if it didn't return.
+			lh.observe(inv, resp.StatusCode, !returned || err != nil, time.Since(start))
+		}()
+	}
+	inv.coldStart = lh.getColdStart().take()
+	if lh.CorrelationHeader != "" && inv.header != nil {
+		// The correlation ID is added before the event is converted, so that it's included in
+		// error responses.
+		ctx = withCorrelationID(ctx, getCorrelationID(inv.header(lh.CorrelationHeader)))
+	}
+	resp, err = lh.handleRequest(ctx, inv, convert, &handlerDuration)
+	if err == nil {
+		lh.addIDHeaders(ctx, inv, &resp)
+	}
+	if duration := time.Since(start); lh.SlowRequestThreshold > 0 && duration > lh.SlowRequestThreshold {
+		lh.logWarning(fmt.Errorf("slow request: %s %s took %v, exceeding the threshold of %v", inv.method, inv.path, duration, lh.SlowRequestThreshold))
+	}
+	if err == nil && lh.Capture != nil {
+		lh.Capture.set(resp)
+	}
+	if err == nil && lh.CaptureHistory != nil {
+		lh.CaptureHistory.add(lh.newExchange(start, inv, resp))
+	}
+	if err == nil && lh.AccessLog != nil {
+		lh.AccessLog(AccessLogEntry{
+			Time:            start,
+			Method:          inv.method,
+			Path:            inv.path,
+			StatusCode:      resp.StatusCode,
+			Bytes:           getResponseBodyLength(resp),
+			Duration:        time.Since(start),
+			HandlerDuration: handlerDuration,
+			SourceIP:        inv.sourceIP,
+			UserAgent:       inv.userAgent,
+		})
+	}
+	returned = true
+	return
+}
+
+// handleRequest executes the handler, setting handlerDuration to the time spent in the handler.
+func (lh LambdaHandler) handleRequest(ctx context.Context, inv invocation, convert func() (*http.Request, error), handlerDuration *time.Duration) (resp events.APIGatewayV2HTTPResponse, err error) {
+	if lh.MaxRequestHeaders > 0 && inv.headerCount > lh.MaxRequestHeaders {
+		return lh.errorResponse(http.StatusBadRequest)
+	}
+	if lh.MaxRequestHeaderBytes > 0 && inv.headerBytes > lh.MaxRequestHeaderBytes {
+		return lh.errorResponse(http.StatusRequestHeaderFieldsTooLarge)
+	}
+
 	// Convert the event to a HTTP request.
-	r, err := lh.convertLambdaEventToHTTPRequest(e)
+	r, err := convert()
 	if err != nil {
-		return
+		return lh.badRequestResponse(err)
 	}
+	r, cancel := lh.prepareRequest(ctx, inv, r)
+	defer cancel()
+	ctx = r.Context()
+
+	w := getResponseWriter()
+	defer putResponseWriter(w)
 
 	// Execute the request.
-	w := httptest.NewRecorder()
-	lh.Handler.ServeHTTP(w, r.WithContext(ctx))
+	if lh.validateRequest(w, r) {
+		handlerStart := time.Now()
+		recovered, stack := lh.serveHTTP(w, r)
+		*handlerDuration = time.Since(handlerStart)
+		if recovered != nil {
+			lh.logError(fmt.Errorf("handler panic: %v\n%s", recovered, stack))
+			if lh.PanicHandler == nil {
+				return lh.panicResponse(recovered, stack)
+			}
+			w.reset()
+			lh.PanicHandler(w, r, recovered)
+		}
+		if r.Context().Err() == context.DeadlineExceeded {
+			lh.logError(fmt.Errorf("handler exceeded the deadline for %s %s", r.Method, r.URL.Path))
+			w.reset()
+			body := lh.DeadlineExceededBody
+			if body == "" {
+				body = http.StatusText(http.StatusGatewayTimeout)
+			}
+			http.Error(w, body, http.StatusGatewayTimeout)
+		}
+		if lh.TreatEmptyAsError && !w.wroteHeader {
+			lh.logError(fmt.Errorf("handler returned an empty response for %s %s", r.Method, r.URL.Path))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		if !lh.isAllowedStatusCode(w.statusCode) {
+			lh.logError(fmt.Errorf("handler returned status %d for %s %s, which is not in AllowedStatusCodes", w.statusCode, r.Method, r.URL.Path))
+			w.reset()
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+	}
+	w.finish()
+	lh.limitCookies(w)
+	if lh.WrapErrorBodies {
+		wrapErrorBody(w)
+	}
+	if id, ok := CorrelationIDFrom(ctx); ok && w.result.Get(lh.CorrelationHeader) == "" {
+		w.result.Set(lh.CorrelationHeader, id)
+	}
+	if inv.requestID != "" && w.result.Get("X-Amzn-RequestId") == "" {
+		w.result.Set("X-Amzn-RequestId", inv.requestID)
+	}
+	lh.sanitizeHeaders(w)
+	if ct := w.result.Get("Content-Type"); ct != "" {
+		w.result.Set("Content-Type", firstContentType(ct))
+	}
+	if lh.AddDateHeader && w.result.Get("Date") == "" {
+		w.result.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	if lh.AddStageHeader && inv.stage != "" && inv.stage != "$default" && w.result.Get("X-Stage") == "" {
+		w.result.Set("X-Stage", inv.stage)
+	}
+	if lh.AddColdStartHeader && w.result.Get("X-Cold-Start") == "" {
+		w.result.Set("X-Cold-Start", strconv.FormatBool(inv.coldStart))
+	}
+	if lh.AddFunctionVersionHeader && w.result.Get("X-Function-Version") == "" {
+		if version := functionVersion(ctx); version != "" {
+			w.result.Set("X-Function-Version", version)
+		}
+	}
+	if lh.DeprecationWarning != nil {
+		if msg := lh.DeprecationWarning(r); msg != "" {
+			w.result.Add("Warning", `299 - "`+warningTextEscaper.Replace(msg)+`"`)
+		}
+	}
+	lh.setCacheControl(w)
+	lh.checkContentLength(r, w)
+	if lh.TrimResponseTrailingNewline {
+		trimTrailingNewline(w)
+	}
+	lh.compressResponse(r, w)
+	if r.Method == http.MethodHead {
+		suppressBody(w)
+	}
 
 	// Convert the recorded result to an API Gateway response.
+	resp, err = lh.convertHTTPResponseToLambdaEvent(w)
+	if err == nil && lh.MaxResponsePayloadSize > 0 {
+		if size := getResponsePayloadSize(resp); size > lh.MaxResponsePayloadSize {
+			lh.logError(fmt.Errorf("response payload of %d bytes exceeds the maximum of %d", size, lh.MaxResponsePayloadSize))
+			return lh.errorResponse(http.StatusInternalServerError)
+		}
+	}
+	return resp, err
+}
+
+// getCorrelationID returns the correlation ID from the value of the request's correlation
+// header, or a new ID if it's empty.
+func getCorrelationID(header string) string {
+	if header == "" {
+		return newCorrelationID()
+	}
+	return header
+}
+
+// addIDHeaders adds the correlation ID and request ID headers to responses that were created
+// without them, e.g. error responses returned before the handler is called, and the responses
+// created by PanicResponse and BadRequestResponse.
+func (lh LambdaHandler) addIDHeaders(ctx context.Context, inv invocation, resp *events.APIGatewayV2HTTPResponse) {
+	add := func(name, value string) {
+		if http.Header(resp.MultiValueHeaders).Get(name) != "" {
+			return
+		}
+		for k := range resp.Headers {
+			if strings.EqualFold(k, name) {
+				return
+			}
+		}
+		if resp.MultiValueHeaders == nil {
+			resp.MultiValueHeaders = make(map[string][]string)
+		}
+		value = strings.Map(func(r rune) rune {
+			if isControl(r) {
+				return -1
+			}
+			return r
+		}, value)
+		http.Header(resp.MultiValueHeaders).Set(name, value)
+	}
+	if id, ok := CorrelationIDFrom(ctx); ok {
+		add(lh.CorrelationHeader, id)
+	}
+	if inv.requestID != "" {
+		add("X-Amzn-RequestId", inv.requestID)
+	}
+}
+
+// prepareRequest applies the options that modify the converted request, and adds the
+// invocation's details to its context. The returned cancel function must be called once the
+// handler has finished with the request.
+func (lh LambdaHandler) prepareRequest(ctx context.Context, inv invocation, r *http.Request) (*http.Request, context.CancelFunc) {
+	if lh.LegacySemicolonQuerySeparator {
+		// Same as http.AllowQuerySemicolons.
+		r.URL.RawQuery = strings.ReplaceAll(r.URL.RawQuery, ";", "&")
+	}
+	if lh.StripDefaultPort {
+		stripDefaultPort(r)
+	}
+	if !lh.DisableTraceHeader {
+		setTraceHeader(r)
+	}
+	if _, ok := CorrelationIDFrom(ctx); !ok && lh.CorrelationHeader != "" {
+		ctx = withCorrelationID(ctx, getCorrelationID(r.Header.Get(lh.CorrelationHeader)))
+	}
+	if inv.requestID != "" {
+		ctx = withRequestID(ctx, inv.requestID)
+	}
+	ctx = withBodyHash(ctx, inv.body, inv.isBase64)
+	cancel := func() {}
+	if deadline, ok := ctx.Deadline(); ok && lh.HonorLambdaDeadline {
+		ctx, cancel = context.WithDeadline(ctx, deadline.Add(-lh.DeadlineMargin))
+	}
+	return r.WithContext(ctx), cancel
+}
+
+// serveHTTP calls the handler, recovering from any panic if RecoverPanics is enabled.
+func (lh LambdaHandler) serveHTTP(w http.ResponseWriter, r *http.Request) (recovered interface{}, stack []byte) {
+	if lh.RecoverPanics {
+		defer func() {
+			if recovered = recover(); recovered != nil {
+				stack = debug.Stack()
+			}
+		}()
+	}
+	h := lh.Handler
+	if lh.middleware != nil {
+		h = lh.middleware.handler(h)
+	}
+	h.ServeHTTP(w, r)
+	return
+}
+
+func (lh LambdaHandler) observe(inv invocation, statusCode int, failed bool, duration time.Duration) {
+	if failed {
+		statusCode = http.StatusInternalServerError
+	}
+	lh.Observer(RequestInfo{
+		Method:     inv.method,
+		Path:       inv.path,
+		StatusCode: statusCode,
+		Duration:   duration,
+		RequestID:  inv.requestID,
+	})
+}
+
+func (lh LambdaHandler) panicResponse(recovered interface{}, stack []byte) (events.APIGatewayV2HTTPResponse, error) {
+	if lh.PanicResponse != nil {
+		return lh.PanicResponse(recovered, stack), nil
+	}
+	if lh.Debug {
+		w := newResponseWriter()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(debugPanicBody{Error: fmt.Sprint(recovered), Stack: string(stack)})
+		w.finish()
+		return lh.convertHTTPResponseToLambdaEvent(w)
+	}
+	return lh.errorResponse(http.StatusInternalServerError)
+}
+
+// debugPanicBody is the body of the 500 response returned when Debug is enabled and a panic is
+// recovered.
+type debugPanicBody struct {
+	Error string `json:"error"`
+	Stack string `json:"stack"`
+}
+
+func getHeaderBytes(e events.APIGatewayV2HTTPRequest) (n int) {
+	for k, v := range e.Headers {
+		n += len(k) + len(v)
+	}
+	for _, c := range e.Cookies {
+		n += len(c)
+	}
+	return n
+}
+
+// sanitizeHeaders removes control characters from response header values, since some API
+// Gateway configurations reject them.
+func (lh LambdaHandler) sanitizeHeaders(w *responseWriter) {
+	for k, values := range w.result {
+		for i, v := range values {
+			if strings.IndexFunc(v, isControl) < 0 {
+				continue
+			}
+			lh.logError(fmt.Errorf("removed control characters from response header %q", k))
+			values[i] = strings.Map(func(r rune) rune {
+				if isControl(r) {
+					return -1
+				}
+				return r
+			}, v)
+		}
+	}
+}
+
+func isControl(r rune) bool {
+	return (r < 0x20 && r != '\t') || r == 0x7f
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// limitCookies enforces MaxResponseCookies, by either dropping the excess cookies, or replacing
+// the response with a 500 status if RejectExcessCookies is enabled.
+func (lh LambdaHandler) limitCookies(w *responseWriter) {
+	cookies := w.result["Set-Cookie"]
+	if lh.MaxResponseCookies <= 0 || len(cookies) <= lh.MaxResponseCookies {
+		return
+	}
+	if lh.RejectExcessCookies {
+		lh.logError(fmt.Errorf("response has %d cookies, which exceeds the maximum of %d", len(cookies), lh.MaxResponseCookies))
+		w.reset()
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		w.finish()
+		return
+	}
+	lh.logError(fmt.Errorf("discarded %d cookies, which exceed the maximum of %d", len(cookies)-lh.MaxResponseCookies, lh.MaxResponseCookies))
+	w.result["Set-Cookie"] = cookies[:lh.MaxResponseCookies]
+}
+
+func (lh LambdaHandler) isAllowedStatusCode(statusCode int) bool {
+	if len(lh.AllowedStatusCodes) == 0 {
+		return true
+	}
+	for _, allowed := range lh.AllowedStatusCodes {
+		if statusCode == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// suppressBody removes the body from the response to a HEAD request. Like the net/http server,
+// the Content-Length is set to the length of the body, if the handler didn't set it.
+func suppressBody(w *responseWriter) {
+	if w.body.Len() > 0 && w.result.Get("Content-Length") == "" && bodyAllowedForStatus(w.statusCode) {
+		w.result.Set("Content-Length", strconv.Itoa(w.body.Len()))
+	}
+	w.body.Reset()
+}
+
+// checkContentLength makes a Content-Length set by the handler consistent with the body that
+// was written. Clients receive the decoded body, so the Content-Length is the length of the
+// decoded body, even if the response is base64 encoded.
+func (lh LambdaHandler) checkContentLength(r *http.Request, w *responseWriter) {
+	cl := w.result.Get("Content-Length")
+	if cl == "" || r.Method == http.MethodHead || !bodyAllowedForStatus(w.statusCode) {
+		return
+	}
+	if n, err := strconv.ParseInt(cl, 10, 64); err == nil && n == int64(w.body.Len()) {
+		return
+	}
+	lh.logWarning(fmt.Errorf("handler set Content-Length %q, but wrote %d bytes", cl, w.body.Len()))
+	w.result.Set("Content-Length", strconv.Itoa(w.body.Len()))
+}
+
+func trimTrailingNewline(w *responseWriter) {
+	b := w.body.Bytes()
+	if len(b) == 0 || b[len(b)-1] != '\n' || !isJSONContentType(w.result.Get("Content-Type")) {
+		return
+	}
+	w.body.Truncate(len(b) - 1)
+	if w.result.Get("Content-Length") != "" {
+		w.result.Set("Content-Length", strconv.Itoa(w.body.Len()))
+	}
+}
+
+// functionVersion returns the qualifier of the invoked function's ARN, e.g. "3" for
+// "arn:aws:lambda:eu-west-1:123456789012:function:name:3".
+func functionVersion(ctx context.Context) string {
+	lc, ok := lambdacontext.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	parts := strings.Split(lc.InvokedFunctionArn, ":")
+	if len(parts) != 8 {
+		return ""
+	}
+	return parts[7]
+}
+
+// wrapErrorBody replaces an empty or plain text body of an error response with a JSON error.
+func wrapErrorBody(w *responseWriter) {
+	if w.statusCode < 400 || w.statusCode > 599 {
+		return
+	}
+	if w.body.Len() > 0 && !matchesMediaType(w.result.Get("Content-Type"), []string{"text/plain"}) {
+		return
+	}
+	message := strings.TrimSpace(w.body.String())
+	if message == "" {
+		message = http.StatusText(w.statusCode)
+	}
+	w.body.Reset()
+	json.NewEncoder(&w.body).Encode(errorEnvelope{Error: errorDetail{Status: w.statusCode, Message: message}})
+	w.result.Set("Content-Type", "application/json")
+	w.result.Set("X-Content-Type-Options", "nosniff")
+	w.result.Del("Content-Length")
+}
+
+// warningTextEscaper escapes a message for use as the quoted text of a Warning header.
+var warningTextEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func (lh LambdaHandler) setCacheControl(w *responseWriter) {
+	if lh.CacheControl == nil || w.result.Get("Cache-Control") != "" {
+		return
+	}
+	if v := lh.CacheControl(w.statusCode); v != "" {
+		w.result.Set("Cache-Control", v)
+	}
+}
+
+func (lh LambdaHandler) badRequestResponse(err error) (events.APIGatewayV2HTTPResponse, error) {
+	lh.logError(fmt.Errorf("bad request: %w", err))
+	if lh.BadRequestResponse != nil {
+		return lh.BadRequestResponse(err), nil
+	}
+	return lh.errorResponse(http.StatusBadRequest)
+}
+
+func (lh LambdaHandler) errorResponse(code int) (resp events.APIGatewayV2HTTPResponse, err error) {
+	w := getResponseWriter()
+	defer putResponseWriter(w)
+	http.Error(w, http.StatusText(code), code)
+	w.finish()
+	if lh.WrapErrorBodies {
+		wrapErrorBody(w)
+	}
 	return lh.convertHTTPResponseToLambdaEvent(w)
 }
 
 func (lh LambdaHandler) convertLambdaEventToHTTPRequest(e events.APIGatewayV2HTTPRequest) (req *http.Request, err error) {
-	body, cl := getRequestBody(e.Body, e.IsBase64Encoded)
-	req, err = http.NewRequest(e.RequestContext.HTTP.Method, e.RawPath, body)
+	body, cl, getBody, err := getRequestBody(e.Body, e.IsBase64Encoded)
+	if err != nil {
+		return
+	}
+	req, err = http.NewRequest(e.RequestContext.HTTP.Method, "/", body)
+	if err != nil {
+		return
+	}
+	req.GetBody = getBody
+	if req.URL, err = parseRequestPath(lh.trimBasePath(e.RawPath, e.RequestContext.Stage)); err != nil {
+		return
+	}
+	if lh.CleanPath {
+		cleanPath(req.URL)
+	}
 	req.URL.RawQuery = e.RawQueryString
+	if req.URL.RawQuery == "" && len(e.QueryStringParameters) > 0 {
+		q := make(url.Values, len(e.QueryStringParameters))
+		for k, v := range e.QueryStringParameters {
+			q.Set(k, v)
+		}
+		req.URL.RawQuery = q.Encode()
+	}
+	req.RequestURI = requestURI(e.RawPath, req.URL.RawQuery)
 	for k, v := range e.Headers {
 		req.Header.Add(k, v)
 	}
+	// API Gateway removes the Cookie header from V2 events, and sets the Cookies field instead.
+	if len(e.Cookies) > 0 && req.Header.Get("Cookie") == "" {
+		req.Header.Set("Cookie", strings.Join(e.Cookies, "; "))
+	}
+	setRequestHeaders(req, cl)
+	setHost(req, e.RequestContext.DomainName)
+	setProto(req, e.RequestContext.HTTP.Protocol)
+	// The source IP is set by API Gateway, so it's more reliable than the forwarded headers.
+	if addr := withPort(e.RequestContext.HTTP.SourceIP); addr != "" {
+		req.RemoteAddr = addr
+	}
+	return
+}
+
+// setTraceHeader adds the X-Ray trace ID of the invocation to the request, so that the X-Ray
+// SDK's instrumentation of requests made by the handler joins the same trace.
+func setTraceHeader(r *http.Request) {
+	if r.Header.Get("X-Amzn-Trace-Id") != "" {
+		return
+	}
+	if id := os.Getenv("_X_AMZN_TRACE_ID"); id != "" {
+		r.Header.Set("X-Amzn-Trace-Id", id)
+	}
+}
+
+// requestURI returns the unmodified request-target sent by the client, as set in
+// http.Request.RequestURI by the net/http server.
+func requestURI(rawPath, rawQuery string) string {
+	if rawPath == "" {
+		rawPath = "/"
+	}
+	if rawQuery == "" {
+		return rawPath
+	}
+	return rawPath + "?" + rawQuery
+}
+
+// setRequestHeaders tidies up the headers of a request converted from an event, where cl is
+// the length of the request body.
+func setRequestHeaders(req *http.Request, cl int) {
+	// TE and Upgrade are hop-by-hop headers that have no meaning to a Lambda handler.
+	req.Header.Del("TE")
+	req.Header.Del("Upgrade")
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		req.Header.Set("Content-Type", firstContentType(ct))
+	}
+	setForwarded(req)
+	// Use the length of the body, rather than any Content-Length header in the event.
 	if cl > 0 {
 		req.Header.Set("Content-Length", strconv.Itoa(cl))
 		req.ContentLength = int64(cl)
+	} else {
+		req.Header.Del("Content-Length")
 	}
-	return
 }
 
-func getRequestBody(s string, isBase64Encoded bool) (body io.Reader, contentLength int) {
+// setProto sets the request's protocol version from the protocol of the event, e.g. "HTTP/2".
+// The HTTP/1.1 default set by http.NewRequest is kept if the protocol is missing or invalid.
+func setProto(req *http.Request, protocol string) {
+	if protocol == "HTTP/2" {
+		// Match the protocol set by the net/http HTTP/2 server.
+		protocol = "HTTP/2.0"
+	}
+	if major, minor, ok := http.ParseHTTPVersion(protocol); ok {
+		req.Proto, req.ProtoMajor, req.ProtoMinor = protocol, major, minor
+	}
+}
+
+// setHost sets the request's Host from the Host header, falling back to the domain name of the
+// event, so that the URL is absolute.
+func setHost(req *http.Request, domainName string) {
+	// The net/http server removes the Host header, and sets the Host field instead.
+	req.Host = req.Header.Get("Host")
+	req.Header.Del("Host")
+	if req.Host == "" {
+		req.Host = domainName
+	}
+	if req.Host == "" {
+		return
+	}
+	req.URL.Host = req.Host
+	req.URL.Scheme = "https"
+	if strings.EqualFold(forwardedProto(req.Header), "http") {
+		req.URL.Scheme = "http"
+	}
+}
+
+// trimBasePath removes the BasePath, or the stage if StripStagePrefix is enabled, from the start
+// of the path. Paths that don't start with it, e.g. because a custom domain's API mapping has
+// already removed it, are unchanged.
+func (lh LambdaHandler) trimBasePath(p, stage string) string {
+	prefix := strings.TrimSuffix(lh.BasePath, "/")
+	if prefix == "" && lh.StripStagePrefix && stage != "" && stage != "$default" {
+		prefix = stage
+	}
+	if prefix == "" {
+		return p
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	if p == prefix {
+		return "/"
+	}
+	if strings.HasPrefix(p, prefix+"/") {
+		return p[len(prefix):]
+	}
+	return p
+}
+
+// parseRequestPath parses the path in the same way as the net/http server, so that a path
+// starting with "//" isn't treated as a host.
+func parseRequestPath(p string) (*url.URL, error) {
+	if p == "" {
+		return &url.URL{}, nil
+	}
+	return url.ParseRequestURI(p)
+}
+
+func cleanPath(u *url.URL) {
+	escaped := u.EscapedPath()
+	if escaped == "" {
+		return
+	}
+	// Clean the escaped path, so that encoded slashes aren't treated as path separators.
+	cleaned := path.Clean(escaped)
+	if strings.HasSuffix(escaped, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	if !strings.HasPrefix(cleaned, "/") {
+		cleaned = "/" + cleaned
+	}
+	parsed, err := url.Parse(cleaned)
+	if err != nil {
+		return
+	}
+	u.Path, u.RawPath = parsed.Path, parsed.RawPath
+}
+
+// getRequestBody returns a reader of the request body, its decoded length, and a function that
+// returns a new reader of the body, for use as the request's GetBody.
+func getRequestBody(s string, isBase64Encoded bool) (body io.Reader, contentLength int, getBody func() (io.ReadCloser, error), err error) {
 	if s == "" {
-		return nil, -1
+		return nil, -1, nil, nil
 	}
+	var enc *base64.Encoding
+	contentLength = len(s)
 	if isBase64Encoded {
-		var padding int
-		if len(s) > 1 {
-			for _, c := range s[len(s)-2:] {
-				if c == '=' {
-					padding++
-				}
+		if enc, contentLength, err = base64EncodingOf(s); err != nil {
+			return nil, -1, nil, fmt.Errorf("failed to decode base64 request body: %w", err)
+		}
+	}
+	getBody = getBodyFunc(s, enc)
+	// getBodyFunc never returns an error.
+	body, _ = getBody()
+	return body, contentLength, getBody, nil
+}
+
+// base64EncodingOf returns the encoding of s, and the length of the decoded data, without
+// decoding it. API Gateway uses standard encoding, but some clients and intermediaries use
+// URL-safe encoding, with or without padding, so the encoding is chosen from the characters
+// used. The characters and structure of s are checked, so that a corrupt body is rejected
+// before the handler is called.
+func base64EncodingOf(s string) (enc *base64.Encoding, decodedLength int, err error) {
+	std, urlSafe := -1, -1
+	var padding, newlines int
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if padding > 0 && c != '=' && c != '\r' && c != '\n' {
+			// Padding is only allowed at the end.
+			return nil, 0, base64.CorruptInputError(i)
+		}
+		switch {
+		case c == '+' || c == '/':
+			if std < 0 {
+				std = i
+			}
+		case c == '-' || c == '_':
+			if urlSafe < 0 {
+				urlSafe = i
+			}
+		case c == '=':
+			if padding++; padding > 2 {
+				return nil, 0, base64.CorruptInputError(i)
 			}
+		case c == '\r' || c == '\n':
+			// The decoder ignores line breaks.
+			newlines++
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+		default:
+			return nil, 0, base64.CorruptInputError(i)
 		}
-		contentLength = (3 * (len(s) / 4)) - padding
-		return base64.NewDecoder(base64.StdEncoding, bytes.NewReader([]byte(s))), contentLength
 	}
-	return bytes.NewReader([]byte(s)), len(s)
+	if std >= 0 && urlSafe >= 0 {
+		// Standard and URL-safe characters can't be mixed.
+		if std > urlSafe {
+			return nil, 0, base64.CorruptInputError(std)
+		}
+		return nil, 0, base64.CorruptInputError(urlSafe)
+	}
+	n := len(s) - newlines
+	if (padding > 0 && n%4 != 0) || n%4 == 1 {
+		return nil, 0, base64.CorruptInputError(len(s))
+	}
+	padded := padding > 0 || n%4 == 0
+	switch {
+	case urlSafe >= 0 && padded:
+		enc = base64.URLEncoding
+	case urlSafe >= 0:
+		enc = base64.RawURLEncoding
+	case padded:
+		enc = base64.StdEncoding
+	default:
+		enc = base64.RawStdEncoding
+	}
+	return enc, enc.DecodedLen(n) - padding, nil
 }
 
-func (lh LambdaHandler) convertHTTPResponseToLambdaEvent(rec *httptest.ResponseRecorder) (resp events.APIGatewayV2HTTPResponse, err error) {
-	result := rec.Result()
-	resp.StatusCode = result.StatusCode
-	resp.Body, resp.IsBase64Encoded = lh.getResponseBody(rec)
-	resp.MultiValueHeaders = result.Header
-	if result.ContentLength > -1 {
-		resp.MultiValueHeaders["Content-Length"] = []string{strconv.FormatInt(result.ContentLength, 10)}
+// getBodyFunc returns a function that returns a new reader of the request body, for use as
+// the request's GetBody, so that the body can be read again, e.g. after ParseForm. If enc is
+// not nil, the body is decoded with it as it's read.
+func getBodyFunc(s string, enc *base64.Encoding) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		if enc != nil {
+			return io.NopCloser(base64.NewDecoder(enc, strings.NewReader(s))), nil
+		}
+		return io.NopCloser(strings.NewReader(s)), nil
 	}
-	for k, v := range result.Trailer {
-		resp.MultiValueHeaders[k] = v
+}
+
+func (lh LambdaHandler) convertHTTPResponseToLambdaEvent(w *responseWriter) (resp events.APIGatewayV2HTTPResponse, err error) {
+	resp.StatusCode = w.statusCode
+	if bodyAllowedForStatus(resp.StatusCode) {
+		resp.Body, resp.IsBase64Encoded = lh.getResponseBody(w)
+	} else if w.body.Len() > 0 {
+		lh.logError(fmt.Errorf("discarded %d byte body written with status %d", w.body.Len(), resp.StatusCode))
 	}
-	cookies := result.Cookies()
+	resp.MultiValueHeaders = w.result
+	cookies := w.cookies()
 	if len(cookies) > 0 {
 		resp.Cookies = make([]string, len(cookies))
 		for i := 0; i < len(cookies); i++ {
@@ -114,34 +1127,169 @@ func (lh LambdaHandler) convertHTTPResponseToLambdaEvent(rec *httptest.ResponseR
 	return
 }
 
-func (lh LambdaHandler) getResponseBody(rec *httptest.ResponseRecorder) (body string, isBase64Encoded bool) {
-	if isTextType(rec.HeaderMap.Get("Content-Type")) {
-		return rec.Body.String(), false
+// getResponsePayloadSize estimates the size of the response once it's serialized to JSON,
+// without the cost of serializing it.
+func getResponsePayloadSize(resp events.APIGatewayV2HTTPResponse) (n int) {
+	// The field names and punctuation of the JSON object.
+	const overhead = 100
+	n = overhead + jsonStringLength(resp.Body)
+	for k, values := range resp.MultiValueHeaders {
+		n += jsonStringLength(k) + 5
+		for _, v := range values {
+			n += jsonStringLength(v) + 3
+		}
+	}
+	for _, c := range resp.Cookies {
+		n += jsonStringLength(c) + 3
 	}
-	return base64.StdEncoding.EncodeToString(rec.Body.Bytes()), true
+	return n
 }
 
-func isTextType(contentType string) bool {
-	if contentType == "" {
-		// API Gateway's default Content-Type is application/json
-		// See https://docs.aws.amazon.com/apigateway/latest/developerguide/request-response-data-mappings.html
-		return true
+// jsonStringLength returns the length of s once it's escaped by json.Marshal, without the
+// quotes.
+func jsonStringLength(s string) (n int) {
+	n = len(s)
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\' || c == '\n' || c == '\r' || c == '\t':
+				n++
+			case c < 0x20 || c == '<' || c == '>' || c == '&':
+				// Escaped as \u00XX.
+				n += 5
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			// Replaced with \ufffd.
+			n += 5
+		case r == '\u2028' || r == '\u2029':
+			// Escaped as \u2028 or \u2029.
+			n += 3
+		}
+		i += size
 	}
-	if strings.HasPrefix(contentType, "text/") {
-		return true
+	return n
+}
+
+func getResponseBodyLength(resp events.APIGatewayV2HTTPResponse) int {
+	if !resp.IsBase64Encoded {
+		return len(resp.Body)
 	}
-	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Basics_of_HTTP/MIME_types/Common_types
-	if contentType == "application/json" {
-		return true
+	return base64.StdEncoding.DecodedLen(len(resp.Body)) - strings.Count(resp.Body, "=")
+}
+
+func (lh LambdaHandler) logError(err error) {
+	if lh.OnError != nil {
+		lh.OnError(err)
 	}
-	if contentType == "image/svg+xml" {
-		return true
+}
+
+func (lh LambdaHandler) logWarning(err error) {
+	if lh.OnWarning != nil {
+		lh.OnWarning(err)
+	}
+}
+
+// bodyAllowedForStatus matches the net/http server's rules on which status codes may have a body.
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent:
+		return false
+	case status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+func (lh LambdaHandler) getResponseBody(w *responseWriter) (body string, isBase64Encoded bool) {
+	// A body with a Content-Encoding (e.g. gzip) is binary, regardless of its Content-Type.
+	if isEncoded(w.result.Get("Content-Encoding")) {
+		return encodeBase64(w.body.Bytes()), true
+	}
+	if lh.isTextType(w.result.Get("Content-Type")) {
+		return w.body.String(), false
+	}
+	return encodeBase64(w.body.Bytes()), true
+}
+
+// encodeBase64 is equivalent to base64.StdEncoding.EncodeToString, but encodes directly into
+// the string's memory, rather than copying the encoded bytes into a string. For large bodies,
+// this halves the peak memory used.
+func encodeBase64(b []byte) string {
+	var sb strings.Builder
+	sb.Grow(base64.StdEncoding.EncodedLen(len(b)))
+	// Encode in chunks that are a multiple of 3 bytes, so that there's no padding until the end.
+	var chunk [4096]byte
+	const chunkInput = len(chunk) / 4 * 3
+	for len(b) > 0 {
+		n := chunkInput
+		if len(b) < n {
+			n = len(b)
+		}
+		base64.StdEncoding.Encode(chunk[:], b[:n])
+		sb.Write(chunk[:base64.StdEncoding.EncodedLen(n)])
+		b = b[n:]
 	}
-	if contentType == "application/xhtml+xml" {
+	return sb.String()
+}
+
+func isEncoded(contentEncoding string) bool {
+	return contentEncoding != "" && !strings.EqualFold(contentEncoding, "identity")
+}
+
+// isTextType returns true if the response body should be returned as text, rather than being
+// base64 encoded.
+func (lh LambdaHandler) isTextType(contentType string) bool {
+	if lh.TextTypeFunc != nil {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			mediaType = contentType
+		}
+		return lh.TextTypeFunc(mediaType)
+	}
+	if len(lh.TextContentTypes) > 0 && matchesMediaType(contentType, lh.TextContentTypes) {
 		return true
 	}
-	if contentType == "application/xml" {
+	return isTextType(contentType)
+}
+
+// firstContentType returns the first of a comma separated list of content types, which may be
+// the result of header folding, e.g. "application/json, text/plain".
+func firstContentType(contentType string) string {
+	if _, _, err := mime.ParseMediaType(contentType); err == nil {
+		return contentType
+	}
+	first, _, _ := strings.Cut(contentType, ",")
+	return strings.TrimSpace(first)
+}
+
+func isTextType(contentType string) bool {
+	if contentType == "" {
+		// API Gateway's default Content-Type is application/json
+		// See https://docs.aws.amazon.com/apigateway/latest/developerguide/request-response-data-mappings.html
 		return true
 	}
-	return false
+	return matchesMediaType(contentType, defaultTextContentTypes)
+}
+
+// defaultTextContentTypes are the media types that are returned as text, rather than being
+// base64 encoded.
+// See https://developer.mozilla.org/en-US/docs/Web/HTTP/Basics_of_HTTP/MIME_types/Common_types
+var defaultTextContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/csv",
+	"application/xhtml+xml",
+	"image/svg+xml",
+	// Newline delimited JSON, see http://ndjson.org/
+	"application/x-ndjson",
 }
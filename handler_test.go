@@ -2,17 +2,25 @@ package awsapigatewayv2handler
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -72,6 +80,25 @@ func TestLambdaEventToHTTPRequest(t *testing.T) {
 				return r
 			},
 		},
+		{
+			name: "hop-by-hop headers are removed",
+			event: events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				Headers: map[string]string{
+					"accept":  "*",
+					"te":      "trailers",
+					"upgrade": "websocket",
+				},
+			},
+			expected: func() *http.Request {
+				r, err := http.NewRequest(http.MethodGet, "/path", nil)
+				if err != nil {
+					panic(err)
+				}
+				r.Header.Add("Accept", "*")
+				return r
+			},
+		},
 		{
 			name: "querystring",
 			event: events.APIGatewayV2HTTPRequest{
@@ -86,6 +113,23 @@ func TestLambdaEventToHTTPRequest(t *testing.T) {
 				return r
 			},
 		},
+		{
+			name: "querystring parameters without a raw querystring",
+			event: events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				QueryStringParameters: map[string]string{
+					"a b": "1&2",
+					"c":   "d=e f",
+				},
+			},
+			expected: func() *http.Request {
+				r, err := http.NewRequest(http.MethodGet, "/path?a+b=1%262&c=d%3De+f", nil)
+				if err != nil {
+					panic(err)
+				}
+				return r
+			},
+		},
 		{
 			name: "JSON POST",
 			event: events.APIGatewayV2HTTPRequest{
@@ -155,6 +199,24 @@ func TestLambdaEventToHTTPRequest(t *testing.T) {
 				return r
 			},
 		},
+		{
+			name: "cookies field",
+			event: events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				Body:    "",
+				Cookies: []string{"name=value", "name2=value2", "name3=value3"},
+			},
+			expected: func() *http.Request {
+				r, err := http.NewRequest(http.MethodGet, "/path", nil)
+				if err != nil {
+					panic(err)
+				}
+				r.AddCookie(&http.Cookie{Name: "name", Value: "value"})
+				r.AddCookie(&http.Cookie{Name: "name2", Value: "value2"})
+				r.AddCookie(&http.Cookie{Name: "name3", Value: "value3"})
+				return r
+			},
+		},
 	}
 	lh := NewLambdaHandler(http.NotFoundHandler())
 	for _, test := range tests {
@@ -244,6 +306,42 @@ func TestHTTPHandlers(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "JSON response with a charset",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				io.WriteString(w, `{"ok":true}`)
+			}),
+			req: events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+			},
+			resp: events.APIGatewayV2HTTPResponse{
+				StatusCode:      200,
+				Body:            `{"ok":true}`,
+				IsBase64Encoded: false,
+				MultiValueHeaders: map[string][]string{
+					"Content-Type": {"application/json; charset=utf-8"},
+				},
+			},
+		},
+		{
+			name: "CSV response",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/csv")
+				io.WriteString(w, "a,b\n1,2\n")
+			}),
+			req: events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+			},
+			resp: events.APIGatewayV2HTTPResponse{
+				StatusCode:      200,
+				Body:            "a,b\n1,2\n",
+				IsBase64Encoded: false,
+				MultiValueHeaders: map[string][]string{
+					"Content-Type": {"text/csv"},
+				},
+			},
+		},
 		{
 			name: "JSON response",
 			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -335,6 +433,34 @@ func TestHTTPHandlers(t *testing.T) {
 				Cookies:         []string{"cookie1=value1", "cookie2=value2"},
 			},
 		},
+		{
+			name: "Set cookies with the same name",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.SetCookie(w, &http.Cookie{
+					Name:   "session",
+					Path:   "/old",
+					MaxAge: -1,
+				})
+				http.SetCookie(w, &http.Cookie{
+					Name:  "session",
+					Value: "new",
+					Path:  "/",
+				})
+			}),
+			req: events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+			},
+			resp: events.APIGatewayV2HTTPResponse{
+				StatusCode: 200,
+				MultiValueHeaders: map[string][]string{
+					"Set-Cookie": {
+						"session=; Path=/old; Max-Age=0",
+						"session=new; Path=/",
+					},
+				},
+				Cookies: []string{"session=; Path=/old; Max-Age=0", "session=new; Path=/"},
+			},
+		},
 		{
 
 			name: "Binary content",
@@ -362,6 +488,46 @@ func TestHTTPHandlers(t *testing.T) {
 				IsBase64Encoded: true,
 			},
 		},
+		{
+			name: "Multipart mixed response",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", `multipart/mixed; boundary="simple boundary"`)
+				io.WriteString(w, "--simple boundary\r\n\r\npart\r\n--simple boundary--\r\n")
+			}),
+			req: events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+			},
+			resp: events.APIGatewayV2HTTPResponse{
+				StatusCode: 200,
+				MultiValueHeaders: map[string][]string{
+					"Content-Type": {`multipart/mixed; boundary="simple boundary"`},
+				},
+				Body:            base64.StdEncoding.EncodeToString([]byte("--simple boundary\r\n\r\npart\r\n--simple boundary--\r\n")),
+				IsBase64Encoded: true,
+			},
+		},
+		{
+			name: "NDJSON response with flushes",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/x-ndjson")
+				enc := json.NewEncoder(w)
+				for i := 0; i < 3; i++ {
+					enc.Encode(map[string]int{"line": i})
+					w.(http.Flusher).Flush()
+				}
+			}),
+			req: events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+			},
+			resp: events.APIGatewayV2HTTPResponse{
+				StatusCode: 200,
+				MultiValueHeaders: map[string][]string{
+					"Content-Type": {"application/x-ndjson"},
+				},
+				Body:            `{"line":0}` + "\n" + `{"line":1}` + "\n" + `{"line":2}` + "\n",
+				IsBase64Encoded: false,
+			},
+		},
 		{
 			name: "Trailing headers",
 			req: events.APIGatewayV2HTTPRequest{
@@ -567,6 +733,13 @@ func TestIsTextType(t *testing.T) {
 		{"application/xhtml+xml", true},
 		{"application/xml", true},
 		{"text/xml", true},
+		{"application/x-ndjson", true},
+		{"application/json; charset=utf-8", true},
+		{"Application/JSON", true},
+		{"text/csv", true},
+		{"application/javascript", true},
+		{"application/octet-stream", false},
+		{"image/png", false},
 	}
 	for _, test := range tests {
 		t.Run(test.input, func(t *testing.T) {
@@ -580,6 +753,9 @@ func TestIsTextType(t *testing.T) {
 
 // The changes took the code from 907,926 ns (nearly 1ms) to 694,463 ns per operation for 1MB of data.
 // Reduced allocations from 39 to 17.
+//
+// Reading the base64 encoded body from the event's string, rather than a copy of it, reduced
+// the memory used per operation for 64MB of data from 89MB to 8KB.
 func BenchmarkLargeRequestBody(b *testing.B) {
 	req := events.APIGatewayV2HTTPRequest{
 		RawPath:        "/path",
@@ -601,6 +777,8 @@ func BenchmarkLargeRequestBody(b *testing.B) {
 	}
 }
 
+// Encoding the base64 body directly into a string reduced the memory used per operation for
+// 64MB of data from 246MB to 157MB, and allocations from 28 to 27.
 func BenchmarkLargeResponseBody(b *testing.B) {
 	req := events.APIGatewayV2HTTPRequest{
 		RawPath:        "/path",
@@ -614,3 +792,2229 @@ func BenchmarkLargeResponseBody(b *testing.B) {
 		lh.Handle(context.Background(), req)
 	}
 }
+
+// Pooling the response writer reduced the memory used per operation from 52KB to 27KB, and
+// allocations from 26 to 24.
+func BenchmarkMediumResponseBody(b *testing.B) {
+	req := events.APIGatewayV2HTTPRequest{
+		RawPath:        "/path",
+		RawQueryString: "val=123",
+	}
+	body := bytes.Repeat([]byte(`{"id":"abc","value":123}`), 1024)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+	lh := NewLambdaHandler(handler)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		lh.Handle(context.Background(), req)
+	}
+}
+
+func TestPooledResponseWritersAreNotAliased(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Path", r.URL.Path)
+		io.WriteString(w, r.URL.Path)
+	})
+	lh := NewLambdaHandler(handler)
+
+	first, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{RawPath: "/first"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{RawPath: "/other"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if first.Body != "/first" {
+		t.Errorf("expected body %q, got %q", "/first", first.Body)
+	}
+	if actual := http.Header(first.MultiValueHeaders).Get("X-Path"); actual != "/first" {
+		t.Errorf("expected header %q, got %q", "/first", actual)
+	}
+}
+
+func TestResponseContentLength(t *testing.T) {
+	tests := []struct {
+		name                  string
+		method                string
+		contentLength         string
+		body                  []byte
+		expectedContentLength string
+		expectedBody          []byte
+		expectedWriteErr      error
+		expectedWarnings      int
+	}{
+		{
+			name:                  "matching text body",
+			contentLength:         "5",
+			body:                  []byte("hello"),
+			expectedContentLength: "5",
+			expectedBody:          []byte("hello"),
+		},
+		{
+			name:                  "base64 encoded body is the decoded length",
+			contentLength:         "4",
+			body:                  []byte{0x00, 0xff, 0x01, 0xfe},
+			expectedContentLength: "4",
+			expectedBody:          []byte{0x00, 0xff, 0x01, 0xfe},
+		},
+		{
+			name:                  "writes beyond the Content-Length are truncated",
+			contentLength:         "3",
+			body:                  []byte("hello"),
+			expectedContentLength: "3",
+			expectedBody:          []byte("hel"),
+			expectedWriteErr:      http.ErrContentLength,
+		},
+		{
+			name:                  "short bodies are corrected",
+			contentLength:         "10",
+			body:                  []byte("hello"),
+			expectedContentLength: "5",
+			expectedBody:          []byte("hello"),
+			expectedWarnings:      1,
+		},
+		{
+			name:                  "invalid values are corrected",
+			contentLength:         "five",
+			body:                  []byte("hello"),
+			expectedContentLength: "5",
+			expectedBody:          []byte("hello"),
+			expectedWarnings:      1,
+		},
+		{
+			name:                  "HEAD responses are unchanged",
+			method:                http.MethodHead,
+			contentLength:         "10",
+			expectedContentLength: "10",
+			expectedBody:          []byte{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var writeErr error
+			var warnings []error
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.Header().Set("Content-Length", test.contentLength)
+				_, writeErr = w.Write(test.body)
+			}))
+			lh.OnWarning = func(err error) {
+				warnings = append(warnings, err)
+			}
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				RequestContext: events.APIGatewayV2HTTPRequestContext{
+					HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+						Method: test.method,
+					},
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if writeErr != test.expectedWriteErr {
+				t.Errorf("expected write error %v, got %v", test.expectedWriteErr, writeErr)
+			}
+			if diff := cmp.Diff([]string{test.expectedContentLength}, resp.MultiValueHeaders["Content-Length"]); diff != "" {
+				t.Errorf("unexpected Content-Length: %s", diff)
+			}
+			body, err := base64.StdEncoding.DecodeString(resp.Body)
+			if err != nil {
+				t.Fatalf("failed to decode body: %v", err)
+			}
+			if !bytes.Equal(body, test.expectedBody) {
+				t.Errorf("expected body %v, got %v", test.expectedBody, body)
+			}
+			if len(warnings) != test.expectedWarnings {
+				t.Errorf("expected %d warnings, got %v", test.expectedWarnings, warnings)
+			}
+		})
+	}
+}
+
+func FuzzConvertLambdaEventToHTTPRequest(f *testing.F) {
+	seeds := []events.APIGatewayV2HTTPRequest{
+		{
+			RawPath: "/path",
+		},
+		{
+			RawPath:        "/path",
+			RawQueryString: "a=123&b=456",
+			Headers: map[string]string{
+				"Accept":     "*",
+				"User-Agent": "Chrome, or something",
+			},
+		},
+		{
+			RawPath: "/path",
+			Body:    "{}",
+			Headers: map[string]string{
+				"Content-Type": "application/json",
+			},
+			RequestContext: events.APIGatewayV2HTTPRequestContext{
+				HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+					Method: "POST",
+					Path:   "/path",
+				},
+			},
+		},
+		{
+			RawPath:         "/path",
+			Body:            base64.StdEncoding.EncodeToString([]byte("12345")),
+			IsBase64Encoded: true,
+			RequestContext: events.APIGatewayV2HTTPRequestContext{
+				HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+					Method: "POST",
+					Path:   "/path",
+				},
+			},
+		},
+		{
+			RawPath: "/path",
+			Headers: map[string]string{
+				"Cookie": "name=value; name2=value2; name3=value3",
+			},
+		},
+	}
+	for _, seed := range seeds {
+		payload, err := json.Marshal(seed)
+		if err != nil {
+			f.Fatalf("failed to marshal seed: %v", err)
+		}
+		f.Add(payload)
+	}
+	f.Add([]byte(`{"rawPath":"/path","body":"not base64!","isBase64Encoded":true}`))
+	f.Add([]byte(`{"rawPath":"%zz","rawQueryString":"a=%zz;b"}`))
+	f.Add([]byte(`{"rawPath":"/path","requestContext":{"http":{"method":"BAD METHOD"}}}`))
+
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Query()
+		r.Cookies()
+		if r.Body != nil {
+			io.Copy(w, r.Body)
+		}
+	}))
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		responseBytes, err := lh.Invoke(context.Background(), payload)
+		if err != nil {
+			return
+		}
+		var resp events.APIGatewayV2HTTPResponse
+		if err := json.Unmarshal(responseBytes, &resp); err != nil {
+			t.Fatalf("invalid response %q: %v", string(responseBytes), err)
+		}
+		if resp.StatusCode < 100 || resp.StatusCode > 999 {
+			t.Errorf("invalid status code %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestPreEncodedResponsesAreNotModified(t *testing.T) {
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	io.WriteString(gw, "Hello, World")
+	if err := gw.Close(); err != nil {
+		t.Fatalf("failed to gzip test data: %v", err)
+	}
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+
+	resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+		RawPath: "/path",
+		Headers: map[string]string{
+			"Accept-Encoding": "gzip",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !resp.IsBase64Encoded {
+		t.Fatalf("expected gzipped body to be base64 encoded")
+	}
+	body, err := base64.StdEncoding.DecodeString(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if !bytes.Equal(body, compressed.Bytes()) {
+		t.Fatalf("expected body to be passed through unmodified")
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to read gzipped body: %v", err)
+	}
+	decompressed, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("failed to decompress body: %v", err)
+	}
+	if string(decompressed) != "Hello, World" {
+		t.Errorf("expected %q, got %q", "Hello, World", string(decompressed))
+	}
+}
+
+func TestBodyIsDiscardedForNoContent(t *testing.T) {
+	var errs []error
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+		io.WriteString(w, "should not be sent")
+	}))
+	lh.OnError = func(err error) {
+		errs = append(errs, err)
+	}
+
+	resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+		RawPath: "/path",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected status %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	if resp.Body != "" {
+		t.Errorf("expected empty body, got %q", resp.Body)
+	}
+	if resp.IsBase64Encoded {
+		t.Errorf("expected IsBase64Encoded to be false")
+	}
+	if len(errs) != 1 {
+		t.Errorf("expected 1 error to be logged, got %d", len(errs))
+	}
+}
+
+func TestHandleJSON(t *testing.T) {
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "Hello, "+r.URL.Query().Get("name"))
+	}))
+	payload := json.RawMessage(`{"rawPath":"/path","rawQueryString":"name=World","requestContext":{"http":{"method":"GET"}}}`)
+
+	raw, err := lh.HandleJSON(context.Background(), payload)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var actual events.APIGatewayV2HTTPResponse
+	if err := json.Unmarshal(raw, &actual); err != nil {
+		t.Fatalf("error unmarshalling response: %v", err)
+	}
+	if actual.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, actual.StatusCode)
+	}
+	if actual.Body != "Hello, World" {
+		t.Errorf("expected body %q, got %q", "Hello, World", actual.Body)
+	}
+}
+
+func TestMaxRequestHeaders(t *testing.T) {
+	tests := []struct {
+		name           string
+		headers        map[string]string
+		expectedStatus int
+	}{
+		{
+			name: "within the limit",
+			headers: map[string]string{
+				"Accept":     "*",
+				"User-Agent": "test",
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "beyond the limit",
+			headers: map[string]string{
+				"Accept":     "*",
+				"User-Agent": "test",
+				"X-Custom":   "value",
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var called bool
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			}))
+			lh.MaxRequestHeaders = 2
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				Headers: test.headers,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("expected status %d, got %d", test.expectedStatus, resp.StatusCode)
+			}
+			if expectCalled := test.expectedStatus == http.StatusOK; called != expectCalled {
+				t.Errorf("expected handler called to be %v, got %v", expectCalled, called)
+			}
+		})
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var entries []AccessLogEntry
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/binary" {
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write([]byte{1, 2, 3, 4})
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "Created")
+	}))
+	lh.AccessLog = func(entry AccessLogEntry) {
+		entries = append(entries, entry)
+	}
+	requests := []events.APIGatewayV2HTTPRequest{
+		{
+			RawPath: "/items",
+			RequestContext: events.APIGatewayV2HTTPRequestContext{
+				HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+					Method:    "POST",
+					SourceIP:  "192.0.2.1",
+					UserAgent: "curl/7.79.1",
+				},
+			},
+		},
+		{
+			RawPath: "/binary",
+			RequestContext: events.APIGatewayV2HTTPRequestContext{
+				HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+					Method:    "GET",
+					SourceIP:  "192.0.2.2",
+					UserAgent: "Mozilla/5.0",
+				},
+			},
+		},
+	}
+	for _, req := range requests {
+		if _, err := lh.Handle(context.Background(), req); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	expected := []AccessLogEntry{
+		{
+			Method:     "POST",
+			Path:       "/items",
+			StatusCode: http.StatusCreated,
+			Bytes:      7,
+			SourceIP:   "192.0.2.1",
+			UserAgent:  "curl/7.79.1",
+		},
+		{
+			Method:     "GET",
+			Path:       "/binary",
+			StatusCode: http.StatusOK,
+			Bytes:      4,
+			SourceIP:   "192.0.2.2",
+			UserAgent:  "Mozilla/5.0",
+		},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, got %d", len(expected), len(entries))
+	}
+	for i := range entries {
+		if entries[i].Time.IsZero() {
+			t.Errorf("entry %d: expected time to be set", i)
+		}
+		if entries[i].Duration <= 0 {
+			t.Errorf("entry %d: expected duration to be set", i)
+		}
+		entries[i].Time = time.Time{}
+		entries[i].Duration = 0
+		entries[i].HandlerDuration = 0
+	}
+	if diff := cmp.Diff(expected, entries); diff != "" {
+		t.Errorf("entries:\n%s", diff)
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		rawPath         string
+		cleanPath       bool
+		expectedPath    string
+		expectedRawPath string
+	}{
+		{rawPath: "/a//b///c", cleanPath: false, expectedPath: "/a//b///c"},
+		{rawPath: "//a/b", cleanPath: false, expectedPath: "//a/b"},
+		{rawPath: "//a//b", cleanPath: true, expectedPath: "/a/b"},
+		{rawPath: "/a//b///c", cleanPath: true, expectedPath: "/a/b/c"},
+		{rawPath: "/a//b/", cleanPath: true, expectedPath: "/a/b/"},
+		{rawPath: "/a/./b/../c", cleanPath: true, expectedPath: "/a/c"},
+		{rawPath: "/../../a", cleanPath: true, expectedPath: "/a"},
+		{rawPath: "//", cleanPath: true, expectedPath: "/"},
+		{rawPath: "/a//b%2F..%2Fc", cleanPath: true, expectedPath: "/a/b/../c", expectedRawPath: "/a/b%2F..%2Fc"},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s %v", test.rawPath, test.cleanPath), func(t *testing.T) {
+			lh := NewLambdaHandler(http.NotFoundHandler())
+			lh.CleanPath = test.cleanPath
+
+			r, err := lh.convertLambdaEventToHTTPRequest(events.APIGatewayV2HTTPRequest{
+				RawPath: test.rawPath,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if r.URL.Path != test.expectedPath {
+				t.Errorf("expected path %q, got %q", test.expectedPath, r.URL.Path)
+			}
+			if r.URL.RawPath != test.expectedRawPath {
+				t.Errorf("expected raw path %q, got %q", test.expectedRawPath, r.URL.RawPath)
+			}
+		})
+	}
+}
+
+func TestURLSafeBase64RequestBody(t *testing.T) {
+	data := []byte{0xfb, 0xff, 0xfe, 0x00, 0xff}
+	tests := []struct {
+		name string
+		body string
+	}{
+		{
+			name: "standard",
+			body: base64.StdEncoding.EncodeToString(data),
+		},
+		{
+			name: "URL-safe",
+			body: base64.URLEncoding.EncodeToString(data),
+		},
+		{
+			name: "URL-safe without padding",
+			body: base64.RawURLEncoding.EncodeToString(data),
+		},
+		{
+			name: "standard without padding",
+			body: base64.RawStdEncoding.EncodeToString(data),
+		},
+		{
+			name: "line breaks",
+			body: "+//+\r\nAP8=",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var actual []byte
+			var contentLength int64
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				actual, _ = io.ReadAll(r.Body)
+				contentLength = r.ContentLength
+			}))
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath:         "/path",
+				Body:            test.body,
+				IsBase64Encoded: true,
+				RequestContext: events.APIGatewayV2HTTPRequestContext{
+					HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+						Method: http.MethodPost,
+					},
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+			if !bytes.Equal(actual, data) {
+				t.Errorf("expected body %v, got %v", data, actual)
+			}
+			if contentLength != int64(len(data)) {
+				t.Errorf("expected content length %d, got %d", len(data), contentLength)
+			}
+		})
+	}
+}
+
+func TestInvalidBase64RequestBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "padding with invalid length", body: "QUJD="},
+		{name: "padding before data", body: "QQ=A"},
+		{name: "padding in the middle", body: "AP8=AP8="},
+		{name: "too much padding", body: "QQ==="},
+		{name: "invalid length", body: "QUJDR"},
+		{name: "single character", body: "Q"},
+		{name: "mixed alphabets", body: "+//-AP8="},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var badRequestErr error
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Error("expected the handler not to be called")
+			}))
+			lh.BadRequestResponse = func(err error) events.APIGatewayV2HTTPResponse {
+				badRequestErr = err
+				return events.APIGatewayV2HTTPResponse{StatusCode: http.StatusBadRequest}
+			}
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath:         "/path",
+				Body:            test.body,
+				IsBase64Encoded: true,
+				RequestContext: events.APIGatewayV2HTTPRequestContext{
+					HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+						Method: http.MethodPost,
+					},
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+			}
+			var corrupt base64.CorruptInputError
+			if !errors.As(badRequestErr, &corrupt) {
+				t.Errorf("expected a base64.CorruptInputError, got %v", badRequestErr)
+			}
+		})
+	}
+}
+
+func TestBadRequestResponse(t *testing.T) {
+	req := events.APIGatewayV2HTTPRequest{
+		RawPath:         "/path",
+		Body:            "not base64!",
+		IsBase64Encoded: true,
+		RequestContext: events.APIGatewayV2HTTPRequestContext{
+			HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+				Method: "POST",
+			},
+		},
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("expected the handler not to be called")
+	})
+	t.Run("default", func(t *testing.T) {
+		lh := NewLambdaHandler(handler)
+
+		resp, err := lh.Handle(context.Background(), req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+	t.Run("custom", func(t *testing.T) {
+		lh := NewLambdaHandler(handler)
+		var received error
+		lh.BadRequestResponse = func(err error) events.APIGatewayV2HTTPResponse {
+			received = err
+			return events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusBadRequest,
+				Headers: map[string]string{
+					"Content-Type": "application/json",
+				},
+				Body: `{"error":"invalid body"}`,
+			}
+		}
+
+		resp, err := lh.Handle(context.Background(), req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if received == nil {
+			t.Errorf("expected the decode error to be passed to BadRequestResponse")
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+		if resp.Body != `{"error":"invalid body"}` {
+			t.Errorf("unexpected body %q", resp.Body)
+		}
+	})
+}
+
+func TestConcurrentInvocationsAreIsolated(t *testing.T) {
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		w.Header().Set("X-Id", id)
+		http.SetCookie(w, &http.Cookie{Name: "id", Value: id})
+		io.WriteString(w, "Hello "+id)
+	}))
+	lh.CompressResponses = true
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath:        "/path",
+				RawQueryString: "id=" + id,
+			})
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", id, err)
+				return
+			}
+			if resp.Body != "Hello "+id {
+				t.Errorf("%s: unexpected body %q", id, resp.Body)
+			}
+			if actual := http.Header(resp.MultiValueHeaders).Get("X-Id"); actual != id {
+				t.Errorf("%s: unexpected header %q", id, actual)
+			}
+			if len(resp.Cookies) != 1 || resp.Cookies[0] != "id="+id {
+				t.Errorf("%s: unexpected cookies %v", id, resp.Cookies)
+			}
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+}
+
+func BenchmarkConcurrentSmallRequests(b *testing.B) {
+	req := events.APIGatewayV2HTTPRequest{
+		RawPath:        "/path",
+		RawQueryString: "val=123",
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "OK")
+	})
+	lh := NewLambdaHandler(handler)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			lh.Handle(context.Background(), req)
+		}
+	})
+}
+
+func TestCacheControl(t *testing.T) {
+	cacheControl := func(statusCode int) string {
+		switch {
+		case statusCode == http.StatusOK:
+			return "public, max-age=60"
+		case statusCode >= 400:
+			return "no-store"
+		}
+		return ""
+	}
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		expected string
+	}{
+		{
+			name: "OK",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "OK")
+			},
+			expected: "public, max-age=60",
+		},
+		{
+			name: "not found",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.NotFound(w, r)
+			},
+			expected: "no-store",
+		},
+		{
+			name: "server error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "failed", http.StatusInternalServerError)
+			},
+			expected: "no-store",
+		},
+		{
+			name: "no header for other statuses",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusCreated)
+			},
+			expected: "",
+		},
+		{
+			name: "handler value takes precedence",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", "private")
+				io.WriteString(w, "OK")
+			},
+			expected: "private",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lh := NewLambdaHandler(test.handler)
+			lh.CacheControl = cacheControl
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if actual := http.Header(resp.MultiValueHeaders).Get("Cache-Control"); actual != test.expected {
+				t.Errorf("expected Cache-Control %q, got %q", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestLowercaseRequestHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    string
+		value  string
+		actual func(r *http.Request) string
+	}{
+		{
+			name:  "User-Agent",
+			key:   "user-agent",
+			value: "Mozilla/5.0 (X11; Linux x86_64)",
+			actual: func(r *http.Request) string {
+				return r.UserAgent()
+			},
+		},
+		{
+			name:  "Origin",
+			key:   "origin",
+			value: "https://example.com",
+			actual: func(r *http.Request) string {
+				return r.Header.Get("Origin")
+			},
+		},
+	}
+	lh := NewLambdaHandler(http.NotFoundHandler())
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := lh.convertLambdaEventToHTTPRequest(events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				Headers: map[string]string{
+					test.key: test.value,
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if actual := test.actual(r); actual != test.value {
+				t.Errorf("expected %q, got %q", test.value, actual)
+			}
+		})
+	}
+}
+
+func TestTreatEmptyAsError(t *testing.T) {
+	tests := []struct {
+		name              string
+		handler           http.HandlerFunc
+		treatEmptyAsError bool
+		expectedStatus    int
+		expectedErrors    int
+	}{
+		{
+			name:              "empty responses are 200 by default",
+			handler:           func(w http.ResponseWriter, r *http.Request) {},
+			treatEmptyAsError: false,
+			expectedStatus:    http.StatusOK,
+		},
+		{
+			name:              "empty responses are 500 when enabled",
+			handler:           func(w http.ResponseWriter, r *http.Request) {},
+			treatEmptyAsError: true,
+			expectedStatus:    http.StatusInternalServerError,
+			expectedErrors:    1,
+		},
+		{
+			name: "explicit status codes are not errors",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+			},
+			treatEmptyAsError: true,
+			expectedStatus:    http.StatusAccepted,
+		},
+		{
+			name: "bodies are not errors",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "OK")
+			},
+			treatEmptyAsError: true,
+			expectedStatus:    http.StatusOK,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var errs []error
+			lh := NewLambdaHandler(test.handler)
+			lh.TreatEmptyAsError = test.treatEmptyAsError
+			lh.OnError = func(err error) {
+				errs = append(errs, err)
+			}
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("expected status %d, got %d", test.expectedStatus, resp.StatusCode)
+			}
+			if len(errs) != test.expectedErrors {
+				t.Errorf("expected %d errors to be logged, got %d", test.expectedErrors, len(errs))
+			}
+		})
+	}
+}
+
+func TestDateHeader(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "OK")
+	})
+	req := events.APIGatewayV2HTTPRequest{
+		RawPath: "/path",
+	}
+	t.Run("not added by default", func(t *testing.T) {
+		lh := NewLambdaHandler(handler)
+
+		resp, err := lh.Handle(context.Background(), req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if _, ok := resp.MultiValueHeaders["Date"]; ok {
+			t.Errorf("expected no Date header, got %v", resp.MultiValueHeaders["Date"])
+		}
+	})
+	t.Run("added when enabled", func(t *testing.T) {
+		lh := NewLambdaHandler(handler)
+		lh.AddDateHeader = true
+
+		resp, err := lh.Handle(context.Background(), req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		dates := resp.MultiValueHeaders["Date"]
+		if len(dates) != 1 {
+			t.Fatalf("expected a single Date header, got %v", dates)
+		}
+		if _, err := http.ParseTime(dates[0]); err != nil {
+			t.Errorf("invalid Date header %q: %v", dates[0], err)
+		}
+	})
+}
+
+func TestMaxRequestHeaderBytes(t *testing.T) {
+	tests := []struct {
+		name           string
+		headers        map[string]string
+		cookies        []string
+		expectedStatus int
+	}{
+		{
+			name: "within the limit",
+			headers: map[string]string{
+				"accept": "*/*",
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "beyond the limit",
+			headers: map[string]string{
+				"accept":   "*/*",
+				"x-custom": strings.Repeat("a", 50),
+			},
+			expectedStatus: http.StatusRequestHeaderFieldsTooLarge,
+		},
+		{
+			name: "cookies count towards the limit",
+			headers: map[string]string{
+				"accept": "*/*",
+			},
+			cookies:        []string{"session=" + strings.Repeat("a", 50)},
+			expectedStatus: http.StatusRequestHeaderFieldsTooLarge,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			lh.MaxRequestHeaderBytes = 50
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				Headers: test.headers,
+				Cookies: test.cookies,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("expected status %d, got %d", test.expectedStatus, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Partial", "true")
+		panic("something went wrong")
+	})
+	req := events.APIGatewayV2HTTPRequest{
+		RawPath: "/path",
+	}
+	t.Run("default response", func(t *testing.T) {
+		var errs []error
+		lh := NewLambdaHandler(handler)
+		lh.RecoverPanics = true
+		lh.OnError = func(err error) {
+			errs = append(errs, err)
+		}
+
+		resp, err := lh.Handle(context.Background(), req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("expected status %d, got %d", http.StatusInternalServerError, resp.StatusCode)
+		}
+		if resp.Body != "Internal Server Error\n" {
+			t.Errorf("unexpected body %q", resp.Body)
+		}
+		if _, ok := resp.MultiValueHeaders["X-Partial"]; ok {
+			t.Errorf("expected headers from the panicking handler to be discarded")
+		}
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), "something went wrong") {
+			t.Errorf("expected the panic to be logged, got %v", errs)
+		}
+	})
+	t.Run("debug response", func(t *testing.T) {
+		lh := NewLambdaHandler(handler)
+		lh.RecoverPanics = true
+		lh.Debug = true
+		lh.OnError = func(err error) {}
+
+		resp, err := lh.Handle(context.Background(), req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("expected status %d, got %d", http.StatusInternalServerError, resp.StatusCode)
+		}
+		if ct := http.Header(resp.MultiValueHeaders).Get("Content-Type"); ct != "application/json" {
+			t.Errorf("expected content type %q, got %q", "application/json", ct)
+		}
+		var body struct {
+			Error string `json:"error"`
+			Stack string `json:"stack"`
+		}
+		if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+			t.Fatalf("failed to unmarshal body %q: %v", resp.Body, err)
+		}
+		if body.Error != "something went wrong" {
+			t.Errorf("expected the panic value in the body, got %q", body.Error)
+		}
+		if !strings.Contains(body.Stack, "goroutine") {
+			t.Errorf("expected the stack trace in the body, got %q", body.Stack)
+		}
+	})
+	t.Run("custom response", func(t *testing.T) {
+		lh := NewLambdaHandler(handler)
+		lh.RecoverPanics = true
+		var receivedStack []byte
+		lh.PanicResponse = func(recovered interface{}, stack []byte) events.APIGatewayV2HTTPResponse {
+			receivedStack = stack
+			return events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusInternalServerError,
+				Headers: map[string]string{
+					"Content-Type": "application/json",
+				},
+				Body: fmt.Sprintf(`{"error":%q}`, recovered),
+			}
+		}
+
+		resp, err := lh.Handle(context.Background(), req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("expected status %d, got %d", http.StatusInternalServerError, resp.StatusCode)
+		}
+		if resp.Body != `{"error":"something went wrong"}` {
+			t.Errorf("unexpected body %q", resp.Body)
+		}
+		if len(receivedStack) == 0 {
+			t.Errorf("expected the stack to be passed to PanicResponse")
+		}
+	})
+	t.Run("custom response takes precedence over debug", func(t *testing.T) {
+		lh := NewLambdaHandler(handler)
+		lh.RecoverPanics = true
+		lh.Debug = true
+		lh.OnError = func(err error) {}
+		lh.PanicResponse = func(recovered interface{}, stack []byte) events.APIGatewayV2HTTPResponse {
+			return events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusServiceUnavailable,
+				Body:       "custom",
+			}
+		}
+
+		resp, err := lh.Handle(context.Background(), req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusServiceUnavailable || resp.Body != "custom" {
+			t.Errorf("expected the custom response, got status %d and body %q", resp.StatusCode, resp.Body)
+		}
+	})
+	t.Run("panics are not recovered by default", func(t *testing.T) {
+		lh := NewLambdaHandler(handler)
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected the panic to propagate")
+			}
+		}()
+		lh.Handle(context.Background(), req)
+	})
+}
+
+func TestErrorResponsesIncludeIDHeaders(t *testing.T) {
+	panicking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("something went wrong")
+	})
+	tests := []struct {
+		name    string
+		handler http.Handler
+		opts    []Option
+		body    string
+	}{
+		{
+			name:    "too many headers",
+			handler: http.NotFoundHandler(),
+			opts: []Option{func(lh *LambdaHandler) {
+				lh.MaxRequestHeaders = 1
+			}},
+		},
+		{
+			name:    "bad request",
+			handler: http.NotFoundHandler(),
+			body:    "not base64!",
+		},
+		{
+			name:    "recovered panic",
+			handler: panicking,
+			opts:    []Option{WithRecover(true)},
+		},
+		{
+			name:    "custom panic response",
+			handler: panicking,
+			opts: []Option{WithRecover(true), func(lh *LambdaHandler) {
+				lh.PanicResponse = func(recovered interface{}, stack []byte) events.APIGatewayV2HTTPResponse {
+					return events.APIGatewayV2HTTPResponse{StatusCode: http.StatusInternalServerError}
+				}
+			}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := append([]Option{func(lh *LambdaHandler) {
+				lh.CorrelationHeader = "X-Correlation-Id"
+				lh.OnError = func(err error) {}
+			}}, test.opts...)
+			lh := NewLambdaHandler(test.handler, opts...)
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				Headers: map[string]string{
+					"x-correlation-id": "abc",
+					"accept":           "*/*",
+				},
+				Body:            test.body,
+				IsBase64Encoded: test.body != "",
+				RequestContext: events.APIGatewayV2HTTPRequestContext{
+					RequestID: "c6af9ac6-7b61-11e6-9a41-93e8deadbeef",
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode < 400 {
+				t.Errorf("expected an error status, got %d", resp.StatusCode)
+			}
+			headers := http.Header(resp.MultiValueHeaders)
+			if id := headers.Get("X-Correlation-Id"); id != "abc" {
+				t.Errorf("expected correlation ID %q, got %q", "abc", id)
+			}
+			if id := headers.Get("X-Amzn-RequestId"); id != "c6af9ac6-7b61-11e6-9a41-93e8deadbeef" {
+				t.Errorf("expected request ID %q, got %q", "c6af9ac6-7b61-11e6-9a41-93e8deadbeef", id)
+			}
+		})
+	}
+}
+
+func TestControlCharactersAreRemovedFromResponseHeaders(t *testing.T) {
+	var errs []error
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Custom", "bad\x00value\x1f")
+		w.Header().Set("X-Tabbed", "a\tb")
+	}))
+	lh.OnError = func(err error) {
+		errs = append(errs, err)
+	}
+
+	resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+		RawPath: "/path",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if actual := http.Header(resp.MultiValueHeaders).Get("X-Custom"); actual != "badvalue" {
+		t.Errorf("expected control characters to be removed, got %q", actual)
+	}
+	if actual := http.Header(resp.MultiValueHeaders).Get("X-Tabbed"); actual != "a\tb" {
+		t.Errorf("expected tabs to be kept, got %q", actual)
+	}
+	if len(errs) != 1 {
+		t.Errorf("expected 1 error to be logged, got %d", len(errs))
+	}
+}
+
+func TestAccessLogHandlerDuration(t *testing.T) {
+	const sleep = 50 * time.Millisecond
+	var entry AccessLogEntry
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(sleep)
+		io.WriteString(w, "OK")
+	}))
+	lh.AccessLog = func(e AccessLogEntry) {
+		entry = e
+	}
+
+	_, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+		RawPath: "/path",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if entry.HandlerDuration < sleep || entry.HandlerDuration > sleep*4 {
+		t.Errorf("expected handler duration close to %v, got %v", sleep, entry.HandlerDuration)
+	}
+	if entry.Duration <= entry.HandlerDuration {
+		t.Errorf("expected total duration %v to be larger than handler duration %v", entry.Duration, entry.HandlerDuration)
+	}
+}
+
+func TestAllowedStatusCodes(t *testing.T) {
+	tests := []struct {
+		name           string
+		status         int
+		expectedStatus int
+		expectedErrors int
+	}{
+		{
+			name:           "allowed",
+			status:         http.StatusCreated,
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "disallowed",
+			status:         http.StatusTeapot,
+			expectedStatus: http.StatusInternalServerError,
+			expectedErrors: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var errs []error
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Custom", "value")
+				w.WriteHeader(test.status)
+				io.WriteString(w, "body")
+			}))
+			lh.AllowedStatusCodes = []int{200, 201, 400, 404, 500}
+			lh.OnError = func(err error) {
+				errs = append(errs, err)
+			}
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("expected status %d, got %d", test.expectedStatus, resp.StatusCode)
+			}
+			if len(errs) != test.expectedErrors {
+				t.Errorf("expected %d errors to be logged, got %d", test.expectedErrors, len(errs))
+			}
+			if test.expectedErrors > 0 && resp.Body != "Internal Server Error\n" {
+				t.Errorf("expected the handler's body to be replaced, got %q", resp.Body)
+			}
+		})
+	}
+}
+
+func TestDeprecationWarning(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected []string
+	}{
+		{
+			path:     "/v1/items",
+			expected: []string{`299 - "Deprecated endpoint, use /v2/items"`},
+		},
+		{
+			path:     "/v1/quoted",
+			expected: []string{`299 - "Use \"/v2\" instead"`},
+		},
+		{
+			path: "/v2/items",
+		},
+	}
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "OK")
+	}))
+	lh.DeprecationWarning = func(r *http.Request) string {
+		switch r.URL.Path {
+		case "/v1/items":
+			return "Deprecated endpoint, use /v2/items"
+		case "/v1/quoted":
+			return `Use "/v2" instead`
+		}
+		return ""
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: test.path,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if diff := cmp.Diff(test.expected, resp.MultiValueHeaders["Warning"]); diff != "" {
+				t.Errorf("unexpected Warning header: %s", diff)
+			}
+		})
+	}
+}
+
+func TestRequestURI(t *testing.T) {
+	tests := []struct {
+		name     string
+		event    events.APIGatewayV2HTTPRequest
+		expected string
+	}{
+		{
+			name: "path",
+			event: events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+			},
+			expected: "/path",
+		},
+		{
+			name: "path and query",
+			event: events.APIGatewayV2HTTPRequest{
+				RawPath:        "/a%2Fb/c",
+				RawQueryString: "x=1&y=%20",
+			},
+			expected: "/a%2Fb/c?x=1&y=%20",
+		},
+		{
+			name: "query string parameters",
+			event: events.APIGatewayV2HTTPRequest{
+				RawPath:               "/path",
+				QueryStringParameters: map[string]string{"x": "1"},
+			},
+			expected: "/path?x=1",
+		},
+	}
+	lh := NewLambdaHandler(http.NotFoundHandler())
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := lh.convertLambdaEventToHTTPRequest(test.event)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if r.RequestURI != test.expected {
+				t.Errorf("expected RequestURI %q, got %q", test.expected, r.RequestURI)
+			}
+		})
+	}
+}
+
+func TestTraceHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		disable  bool
+		expected string
+	}{
+		{
+			name:     "added from the environment",
+			expected: "Root=1-5759e988-bd862e3fe1be46a994272793;Sampled=1",
+		},
+		{
+			name: "existing header is kept",
+			headers: map[string]string{
+				"x-amzn-trace-id": "Root=1-00000000-000000000000000000000000",
+			},
+			expected: "Root=1-00000000-000000000000000000000000",
+		},
+		{
+			name:    "disabled",
+			disable: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("_X_AMZN_TRACE_ID", "Root=1-5759e988-bd862e3fe1be46a994272793;Sampled=1")
+			var actual string
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				actual = r.Header.Get("X-Amzn-Trace-Id")
+			}))
+			lh.DisableTraceHeader = test.disable
+
+			_, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				Headers: test.headers,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if actual != test.expected {
+				t.Errorf("expected trace header %q, got %q", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestFunctionVersionHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		arn      string
+		expected []string
+	}{
+		{
+			name:     "version qualifier",
+			arn:      "arn:aws:lambda:eu-west-1:123456789012:function:api:42",
+			expected: []string{"42"},
+		},
+		{
+			name:     "alias qualifier",
+			arn:      "arn:aws:lambda:eu-west-1:123456789012:function:api:live",
+			expected: []string{"live"},
+		},
+		{
+			name: "unqualified",
+			arn:  "arn:aws:lambda:eu-west-1:123456789012:function:api",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lh := NewLambdaHandler(http.NotFoundHandler())
+			lh.AddFunctionVersionHeader = true
+			ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{
+				InvokedFunctionArn: test.arn,
+			})
+
+			resp, err := lh.Handle(ctx, events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if diff := cmp.Diff(test.expected, resp.MultiValueHeaders["X-Function-Version"]); diff != "" {
+				t.Errorf("unexpected X-Function-Version header: %s", diff)
+			}
+		})
+	}
+}
+
+func TestMaxResponsePayloadSize(t *testing.T) {
+	tests := []struct {
+		name           string
+		header         string
+		body           string
+		expectedStatus int
+		expectedErrors int
+	}{
+		{
+			name:           "small response",
+			header:         "value",
+			body:           "OK",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "large headers and body",
+			header:         strings.Repeat("h", 600),
+			body:           strings.Repeat("b", 600),
+			expectedStatus: http.StatusInternalServerError,
+			expectedErrors: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var errs []error
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Large", test.header)
+				io.WriteString(w, test.body)
+			}))
+			lh.MaxResponsePayloadSize = 1024
+			lh.OnError = func(err error) {
+				errs = append(errs, err)
+			}
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("expected status %d, got %d", test.expectedStatus, resp.StatusCode)
+			}
+			if len(errs) != test.expectedErrors {
+				t.Errorf("expected %d errors, got %v", test.expectedErrors, errs)
+			}
+			if actual := len(mustMarshal(t, resp)); test.expectedErrors == 0 && actual > lh.MaxResponsePayloadSize {
+				t.Errorf("expected the payload to be within the limit, got %d bytes", actual)
+			}
+		})
+	}
+}
+
+func TestResponsePayloadSizeEstimate(t *testing.T) {
+	resp := events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		MultiValueHeaders: map[string][]string{
+			"Content-Type": {"text/plain; charset=utf-8"},
+			"X-Values":     {"a", "b"},
+		},
+		Cookies:         []string{"a=1", "b=2"},
+		Body:            strings.Repeat("b", 1000),
+		IsBase64Encoded: true,
+	}
+	estimate := getResponsePayloadSize(resp)
+	if actual := len(mustMarshal(t, resp)); estimate < actual {
+		t.Errorf("expected the estimate of %d bytes not to be less than the actual size of %d bytes", estimate, actual)
+	}
+}
+
+func TestResponsePayloadSizeEstimateEscaping(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{
+			name: "quotes",
+			body: strings.Repeat(`"`, 1000),
+		},
+		{
+			name: "HTML",
+			body: strings.Repeat("<a>&", 250),
+		},
+		{
+			name: "control characters",
+			body: strings.Repeat("\x00\n", 500),
+		},
+		{
+			name: "invalid UTF-8 and line separators",
+			body: strings.Repeat("\xff\u2028", 250),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusOK,
+				MultiValueHeaders: map[string][]string{
+					"Link": {`<https://example.com/?a=1&b=2>; rel="next"`},
+				},
+				Body: test.body,
+			}
+			estimate := getResponsePayloadSize(resp)
+			if actual := len(mustMarshal(t, resp)); estimate < actual {
+				t.Errorf("expected the estimate of %d bytes not to be less than the actual size of %d bytes", estimate, actual)
+			}
+		})
+	}
+
+	// The escaped body exceeds the limit, even though the unescaped body doesn't.
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, strings.Repeat("<", 1000))
+	}))
+	lh.MaxResponsePayloadSize = 2000
+	lh.OnError = func(err error) {}
+	resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+		RawPath: "/path",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected status %d, got %d", http.StatusInternalServerError, resp.StatusCode)
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	return b
+}
+
+func TestUse(t *testing.T) {
+	var calls []string
+	record := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls = append(calls, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	requireAuth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, "handler")
+	}))
+	lh.Use(record("first"), record("second"))
+	lh.Use(requireAuth, record("third"))
+
+	resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+		RawPath: "/path",
+		Headers: map[string]string{
+			"authorization": "Bearer token",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if diff := cmp.Diff([]string{"first", "second", "third", "handler"}, calls); diff != "" {
+		t.Errorf("unexpected call order: %s", diff)
+	}
+
+	calls = nil
+	resp, err = lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+		RawPath: "/path",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	if diff := cmp.Diff([]string{"first", "second"}, calls); diff != "" {
+		t.Errorf("unexpected call order: %s", diff)
+	}
+}
+
+func TestUseComposesMiddlewareOnce(t *testing.T) {
+	var composed int
+	lh := NewLambdaHandler(http.NotFoundHandler())
+	lh.Use(func(next http.Handler) http.Handler {
+		composed++
+		return next
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{RawPath: "/path"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if composed != 1 {
+		t.Errorf("expected the middleware to be composed once, got %d", composed)
+	}
+}
+
+func TestWrapErrorBodies(t *testing.T) {
+	tests := []struct {
+		name         string
+		handler      http.HandlerFunc
+		expectedType string
+		expectedBody string
+	}{
+		{
+			name: "plain text error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "database unavailable", http.StatusInternalServerError)
+			},
+			expectedType: "application/json",
+			expectedBody: `{"error":{"status":500,"message":"database unavailable"}}` + "\n",
+		},
+		{
+			name: "empty error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+			},
+			expectedType: "application/json",
+			expectedBody: `{"error":{"status":404,"message":"Not Found"}}` + "\n",
+		},
+		{
+			name: "JSON error is unchanged",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, `{"message":"invalid name"}`)
+			},
+			expectedType: "application/json",
+			expectedBody: `{"message":"invalid name"}`,
+		},
+		{
+			name: "HTML error is unchanged",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.WriteHeader(http.StatusForbidden)
+				io.WriteString(w, "<h1>Forbidden</h1>")
+			},
+			expectedType: "text/html",
+			expectedBody: "<h1>Forbidden</h1>",
+		},
+		{
+			name: "success is unchanged",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				io.WriteString(w, "OK")
+			},
+			expectedType: "text/plain",
+			expectedBody: "OK",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lh := NewLambdaHandler(test.handler)
+			lh.WrapErrorBodies = true
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if ct := http.Header(resp.MultiValueHeaders).Get("Content-Type"); ct != test.expectedType {
+				t.Errorf("expected Content-Type %q, got %q", test.expectedType, ct)
+			}
+			if resp.Body != test.expectedBody {
+				t.Errorf("expected body %q, got %q", test.expectedBody, resp.Body)
+			}
+		})
+	}
+}
+
+func TestHeadRequests(t *testing.T) {
+	tests := []struct {
+		name                  string
+		handler               http.HandlerFunc
+		expectedContentLength string
+	}{
+		{
+			name: "body is suppressed",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("ETag", `"abc"`)
+				io.WriteString(w, "hello")
+			},
+			expectedContentLength: "5",
+		},
+		{
+			name: "Content-Length set by the handler is kept",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("ETag", `"abc"`)
+				w.Header().Set("Content-Length", "1024")
+			},
+			expectedContentLength: "1024",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lh := NewLambdaHandler(test.handler)
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				RequestContext: events.APIGatewayV2HTTPRequestContext{
+					HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+						Method: http.MethodHead,
+					},
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.Body != "" {
+				t.Errorf("expected an empty body, got %q", resp.Body)
+			}
+			h := http.Header(resp.MultiValueHeaders)
+			if cl := h.Get("Content-Length"); cl != test.expectedContentLength {
+				t.Errorf("expected Content-Length %q, got %q", test.expectedContentLength, cl)
+			}
+			if ct := h.Get("Content-Type"); ct != "text/plain" {
+				t.Errorf("expected Content-Type %q, got %q", "text/plain", ct)
+			}
+			if etag := h.Get("ETag"); etag != `"abc"` {
+				t.Errorf("expected ETag %q, got %q", `"abc"`, etag)
+			}
+		})
+	}
+}
+
+func TestProto(t *testing.T) {
+	tests := []struct {
+		protocol      string
+		expected      string
+		expectedMajor int
+		expectedMinor int
+	}{
+		{
+			protocol:      "",
+			expected:      "HTTP/1.1",
+			expectedMajor: 1,
+			expectedMinor: 1,
+		},
+		{
+			protocol:      "HTTP/1.0",
+			expected:      "HTTP/1.0",
+			expectedMajor: 1,
+			expectedMinor: 0,
+		},
+		{
+			protocol:      "HTTP/2",
+			expected:      "HTTP/2.0",
+			expectedMajor: 2,
+			expectedMinor: 0,
+		},
+		{
+			protocol:      "invalid",
+			expected:      "HTTP/1.1",
+			expectedMajor: 1,
+			expectedMinor: 1,
+		},
+	}
+	lh := NewLambdaHandler(http.NotFoundHandler())
+	for _, test := range tests {
+		t.Run(test.protocol, func(t *testing.T) {
+			r, err := lh.convertLambdaEventToHTTPRequest(events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				RequestContext: events.APIGatewayV2HTTPRequestContext{
+					HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+						Protocol: test.protocol,
+					},
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if r.Proto != test.expected || r.ProtoMajor != test.expectedMajor || r.ProtoMinor != test.expectedMinor {
+				t.Errorf("expected %s (%d.%d), got %s (%d.%d)", test.expected, test.expectedMajor, test.expectedMinor, r.Proto, r.ProtoMajor, r.ProtoMinor)
+			}
+		})
+	}
+}
+
+func TestTrimResponseTrailingNewline(t *testing.T) {
+	tests := []struct {
+		name         string
+		trim         bool
+		contentType  string
+		expectedBody string
+	}{
+		{
+			name:         "disabled",
+			contentType:  "application/json",
+			expectedBody: "{\"ok\":true}\n",
+		},
+		{
+			name:         "enabled",
+			trim:         true,
+			contentType:  "application/json",
+			expectedBody: `{"ok":true}`,
+		},
+		{
+			name:         "enabled, not JSON",
+			trim:         true,
+			contentType:  "text/plain",
+			expectedBody: "{\"ok\":true}\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", test.contentType)
+				json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+			}))
+			lh.TrimResponseTrailingNewline = test.trim
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.Body != test.expectedBody {
+				t.Errorf("expected body %q, got %q", test.expectedBody, resp.Body)
+			}
+		})
+	}
+}
+
+func TestFoldedContentType(t *testing.T) {
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v map[string]string
+		if err := DecodeJSON(r, &v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json, text/plain")
+		json.NewEncoder(w).Encode(v)
+	}))
+
+	resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+		RawPath: "/path",
+		Headers: map[string]string{
+			"Content-Type": "application/json, text/plain",
+		},
+		Body: `{"name":"value"}`,
+		RequestContext: events.APIGatewayV2HTTPRequestContext{
+			HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+				Method: http.MethodPost,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, resp.StatusCode, resp.Body)
+	}
+	if resp.IsBase64Encoded {
+		t.Errorf("expected the JSON response not to be base64 encoded")
+	}
+	if ct := resp.MultiValueHeaders["Content-Type"]; len(ct) != 1 || ct[0] != "application/json" {
+		t.Errorf("expected Content-Type %q, got %q", "application/json", ct)
+	}
+	if resp.Body != "{\"name\":\"value\"}\n" {
+		t.Errorf("unexpected body %q", resp.Body)
+	}
+}
+
+func TestStageHeader(t *testing.T) {
+	tests := []struct {
+		stage    string
+		expected []string
+	}{
+		{stage: "prod", expected: []string{"prod"}},
+		{stage: "$default", expected: nil},
+	}
+	for _, test := range tests {
+		t.Run(test.stage, func(t *testing.T) {
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "OK")
+			}))
+			lh.AddStageHeader = true
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				RequestContext: events.APIGatewayV2HTTPRequestContext{
+					Stage: test.stage,
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if diff := cmp.Diff(test.expected, resp.MultiValueHeaders["X-Stage"]); diff != "" {
+				t.Errorf("unexpected X-Stage header:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDeadlineExceeded(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		expectedBody string
+	}{
+		{
+			name:         "default body",
+			expectedBody: "Gateway Timeout\n",
+		},
+		{
+			name:         "custom body",
+			body:         `{"error":"timeout"}`,
+			expectedBody: "{\"error\":\"timeout\"}\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var errs []error
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "partial")
+				<-r.Context().Done()
+			}))
+			lh.DeadlineExceededBody = test.body
+			lh.OnError = func(err error) {
+				errs = append(errs, err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			resp, err := lh.Handle(ctx, events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != http.StatusGatewayTimeout {
+				t.Errorf("expected status %d, got %d", http.StatusGatewayTimeout, resp.StatusCode)
+			}
+			if resp.Body != test.expectedBody {
+				t.Errorf("expected body %q, got %q", test.expectedBody, resp.Body)
+			}
+			if len(errs) != 1 {
+				t.Errorf("expected 1 error, got %d", len(errs))
+			}
+		})
+	}
+}
+
+func TestHonorLambdaDeadline(t *testing.T) {
+	tests := []struct {
+		name         string
+		honor        bool
+		expectMargin bool
+	}{
+		{name: "disabled", honor: false, expectMargin: false},
+		{name: "enabled", honor: true, expectMargin: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lambdaDeadline := time.Now().Add(time.Minute)
+			var actual time.Time
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				actual, _ = r.Context().Deadline()
+			}))
+			lh.HonorLambdaDeadline = test.honor
+			lh.DeadlineMargin = time.Second
+			ctx, cancel := context.WithDeadline(context.Background(), lambdaDeadline)
+			defer cancel()
+
+			_, err := lh.Handle(ctx, events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			expected := lambdaDeadline
+			if test.expectMargin {
+				expected = lambdaDeadline.Add(-time.Second)
+			}
+			if !actual.Equal(expected) {
+				t.Errorf("expected deadline %v, got %v", expected, actual)
+			}
+		})
+	}
+}
+
+func TestSlowRequestThreshold(t *testing.T) {
+	tests := []struct {
+		name             string
+		sleep            time.Duration
+		expectedWarnings int
+	}{
+		{name: "fast", sleep: 0, expectedWarnings: 0},
+		{name: "slow", sleep: 20 * time.Millisecond, expectedWarnings: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var warnings []error
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(test.sleep)
+			}))
+			lh.SlowRequestThreshold = 10 * time.Millisecond
+			lh.OnWarning = func(err error) {
+				warnings = append(warnings, err)
+			}
+
+			_, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/slow",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(warnings) != test.expectedWarnings {
+				t.Fatalf("expected %d warnings, got %v", test.expectedWarnings, warnings)
+			}
+			if len(warnings) > 0 && !strings.Contains(warnings[0].Error(), "/slow") {
+				t.Errorf("expected the warning to include the path, got %q", warnings[0])
+			}
+		})
+	}
+}
+
+func TestLegacySemicolonQuerySeparator(t *testing.T) {
+	tests := []struct {
+		name     string
+		legacy   bool
+		expected url.Values
+	}{
+		{
+			name:     "default",
+			expected: url.Values{},
+		},
+		{
+			name:     "legacy",
+			legacy:   true,
+			expected: url.Values{"a": {"1"}, "b": {"2"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var actual url.Values
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				actual = r.URL.Query()
+			}))
+			lh.LegacySemicolonQuerySeparator = test.legacy
+
+			_, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath:        "/path",
+				RawQueryString: "a=1;b=2",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if diff := cmp.Diff(test.expected, actual); diff != "" {
+				t.Errorf("unexpected query:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMaxResponseCookies(t *testing.T) {
+	tests := []struct {
+		name            string
+		cookies         int
+		reject          bool
+		expectedStatus  int
+		expectedCookies []string
+		expectedErrors  int
+	}{
+		{
+			name:            "within the limit",
+			cookies:         2,
+			expectedStatus:  http.StatusOK,
+			expectedCookies: []string{"c0=v", "c1=v"},
+		},
+		{
+			name:            "beyond the limit",
+			cookies:         3,
+			expectedStatus:  http.StatusOK,
+			expectedCookies: []string{"c0=v", "c1=v"},
+			expectedErrors:  1,
+		},
+		{
+			name:           "beyond the limit, rejected",
+			cookies:        3,
+			reject:         true,
+			expectedStatus: http.StatusInternalServerError,
+			expectedErrors: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var errs []error
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for i := 0; i < test.cookies; i++ {
+					http.SetCookie(w, &http.Cookie{Name: fmt.Sprintf("c%d", i), Value: "v"})
+				}
+			}))
+			lh.MaxResponseCookies = 2
+			lh.RejectExcessCookies = test.reject
+			lh.OnError = func(err error) {
+				errs = append(errs, err)
+			}
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("expected status %d, got %d", test.expectedStatus, resp.StatusCode)
+			}
+			if diff := cmp.Diff(test.expectedCookies, resp.Cookies); diff != "" {
+				t.Errorf("unexpected cookies:\n%s", diff)
+			}
+			if len(errs) != test.expectedErrors {
+				t.Errorf("expected %d errors, got %v", test.expectedErrors, errs)
+			}
+		})
+	}
+}
+
+func TestEncodeBase64(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 4, 3071, 3072, 3073, 10000} {
+		t.Run(strconv.Itoa(n), func(t *testing.T) {
+			expected := base64.StdEncoding.EncodeToString(binaryData[:n])
+			if actual := encodeBase64(binaryData[:n]); actual != expected {
+				t.Errorf("expected %q, got %q", expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,450 @@
+package awsapigatewayv2handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Pagination reads the limit and cursor query string parameters. The limit is
+// set to defaultLimit if it's missing or invalid, and is capped at maxLimit.
+func Pagination(r *http.Request, defaultLimit, maxLimit int) (limit int, cursor string) {
+	q := r.URL.Query()
+	cursor = q.Get("cursor")
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit < 1 {
+		limit = defaultLimit
+	}
+	if maxLimit > 0 && limit > maxLimit {
+		limit = maxLimit
+	}
+	return limit, cursor
+}
+
+// AbsoluteURL returns an absolute URL for the path (which may include a query string),
+// using the request's host, and the scheme of the request's URL. If the URL doesn't have a
+// scheme, https is used if the request was made over TLS.
+func AbsoluteURL(r *http.Request, path string) string {
+	scheme := r.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	}
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return scheme + "://" + host + path
+}
+
+// QueryCaseInsensitive returns the first value of the query string parameter with a name that
+// matches the key, ignoring case, e.g. "limit" matches "?Limit=10". Parameters are checked in
+// the order they appear in the query string.
+func QueryCaseInsensitive(r *http.Request, key string) string {
+	query := r.URL.RawQuery
+	for query != "" {
+		var param string
+		param, query, _ = strings.Cut(query, "&")
+		if strings.Contains(param, ";") {
+			// Ignored by r.URL.Query().
+			continue
+		}
+		name, value, _ := strings.Cut(param, "=")
+		name, err := url.QueryUnescape(name)
+		if err != nil || !strings.EqualFold(name, key) {
+			continue
+		}
+		if value, err = url.QueryUnescape(value); err != nil {
+			continue
+		}
+		return value
+	}
+	return ""
+}
+
+// ResetBody replaces the request body with a new reader of the original body, so that the
+// body can be read again after it has been consumed, e.g. by ParseForm. The body isn't
+// restored automatically, so ResetBody must be called before each additional read.
+func ResetBody(r *http.Request) error {
+	if r.GetBody == nil {
+		return nil
+	}
+	body, err := r.GetBody()
+	if err != nil {
+		return err
+	}
+	r.Body = body
+	return nil
+}
+
+// APIKey returns the value of the request's X-Api-Key header.
+func APIKey(r *http.Request) string {
+	return r.Header.Get("X-Api-Key")
+}
+
+// Redirect redirects the request to the url with an empty body. Unlike http.Redirect, no
+// HTML body is written, so the response isn't base64 encoded. It panics if status isn't
+// a 3xx status code.
+func Redirect(w http.ResponseWriter, url string, status int) {
+	if status < 300 || status > 399 {
+		panic(fmt.Sprintf("invalid redirect code %v", status))
+	}
+	w.Header().Set("Location", url)
+	w.WriteHeader(status)
+}
+
+var (
+	// ErrNotJSON is returned by DecodeJSON when the request doesn't have a JSON Content-Type.
+	ErrNotJSON = errors.New("request body is not JSON")
+	// ErrBodyTooLarge is returned by DecodeJSON when the request body exceeds the maximum size.
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+// DefaultMaxJSONBytes is the maximum size of request body that DecodeJSON will read. It
+// matches API Gateway's maximum payload size.
+const DefaultMaxJSONBytes = 10 * 1024 * 1024
+
+// DecodeJSONOptions configures DecodeJSONWithOptions.
+type DecodeJSONOptions struct {
+	// MaxBytes is the maximum size of the request body. Defaults to DefaultMaxJSONBytes.
+	MaxBytes int64
+	// DisallowUnknownFields returns an error if the body contains fields that aren't in v.
+	DisallowUnknownFields bool
+	// IgnoreContentType decodes the body as JSON regardless of the request's Content-Type.
+	IgnoreContentType bool
+}
+
+// DecodeJSON decodes a JSON request body into v, using the default options.
+func DecodeJSON(r *http.Request, v interface{}) error {
+	return DecodeJSONWithOptions(r, v, DecodeJSONOptions{})
+}
+
+// DecodeJSONLenient decodes a JSON request body into v, regardless of the request's
+// Content-Type, for clients that send JSON as e.g. text/plain.
+func DecodeJSONLenient(r *http.Request, v interface{}) error {
+	return DecodeJSONWithOptions(r, v, DecodeJSONOptions{IgnoreContentType: true})
+}
+
+// DecodeJSONWithOptions checks that the request has a JSON Content-Type, and decodes the
+// body into v. If the body isn't valid JSON, or doesn't match v, a *DecodeJSONError
+// is returned.
+func DecodeJSONWithOptions(r *http.Request, v interface{}, opts DecodeJSONOptions) error {
+	if !opts.IgnoreContentType && !isJSONContentType(r.Header.Get("Content-Type")) {
+		return ErrNotJSON
+	}
+	maxBytes := opts.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxJSONBytes
+	}
+	if r.ContentLength > maxBytes {
+		return ErrBodyTooLarge
+	}
+	if r.Body == nil {
+		return io.EOF
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > maxBytes {
+		return ErrBodyTooLarge
+	}
+	d := json.NewDecoder(bytes.NewReader(body))
+	if opts.DisallowUnknownFields {
+		d.DisallowUnknownFields()
+	}
+	if err := d.Decode(v); err != nil {
+		return newDecodeJSONError(err)
+	}
+	return nil
+}
+
+// DecodeJSONError is returned by DecodeJSON when the body isn't valid JSON, or a value doesn't
+// match the type of its field. Unlike the encoding/json errors, the message is suitable for
+// returning to clients.
+type DecodeJSONError struct {
+	// Field is the path of the field with the wrong type, e.g. "items.count". It's empty for
+	// syntax errors.
+	Field string
+	// Message describes the error, e.g. `field "count" must be an integer`.
+	Message string
+	// Err is the underlying encoding/json error.
+	Err error
+}
+
+func (e *DecodeJSONError) Error() string {
+	return e.Message
+}
+
+func (e *DecodeJSONError) Unwrap() error {
+	return e.Err
+}
+
+func newDecodeJSONError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		if typeErr.Field == "" {
+			return &DecodeJSONError{
+				Message: fmt.Sprintf("request body must be %s", describeJSONType(typeErr.Type)),
+				Err:     err,
+			}
+		}
+		return &DecodeJSONError{
+			Field:   typeErr.Field,
+			Message: fmt.Sprintf("field %q must be %s", typeErr.Field, describeJSONType(typeErr.Type)),
+			Err:     err,
+		}
+	}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return &DecodeJSONError{
+			Message: fmt.Sprintf("request body contains invalid JSON at position %d", syntaxErr.Offset),
+			Err:     err,
+		}
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return &DecodeJSONError{
+			Message: "request body contains incomplete JSON",
+			Err:     err,
+		}
+	}
+	return err
+}
+
+// describeJSONType describes the JSON value expected for a Go type.
+func describeJSONType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	}
+	return t.String()
+}
+
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// DecodeQuery populates the fields of the struct pointed to by v from the request's query
+// string parameters, using the field's "query" tag as the parameter name, e.g.
+//
+//	type Params struct {
+//		Limit  int    `query:"limit"`
+//		Search string `query:"q"`
+//	}
+//
+// String, bool, int, uint and float fields are supported. Fields without a tag, and
+// fields without a matching parameter, are left unchanged.
+func DecodeQuery(r *http.Request, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("DecodeQuery: expected a non-nil pointer to a struct, got %T", v)
+	}
+	rv = rv.Elem()
+	q := r.URL.Query()
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Type().Field(i)
+		name := field.Tag.Get("query")
+		if name == "" || name == "-" || !field.IsExported() {
+			continue
+		}
+		values, ok := q[name]
+		if !ok || len(values) == 0 {
+			continue
+		}
+		if err := setField(rv.Field(i), values[0]); err != nil {
+			return fmt.Errorf("query parameter %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setField(f reflect.Value, s string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(v)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v, err := strconv.ParseInt(s, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetInt(v)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v, err := strconv.ParseUint(s, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetUint(v)
+	case reflect.Float32, reflect.Float64:
+		v, err := strconv.ParseFloat(s, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetFloat(v)
+	default:
+		return fmt.Errorf("unsupported field type %v", f.Type())
+	}
+	return nil
+}
+
+type errorEnvelope struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorEnvelope{Error: errorDetail{Status: status, Message: message}})
+}
+
+// NotFoundHandler returns a handler that responds with a JSON 404 error, e.g.
+// {"error":{"status":404,"message":"Not Found"}}.
+func NotFoundHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	})
+}
+
+// NegotiateLanguage returns the supported language that best matches the request's
+// Accept-Language header, taking quality values into account. A wildcard matches the first
+// supported language that isn't excluded with a quality value of zero, e.g. "en;q=0, *". If
+// there's no match, the first supported language is returned.
+func NegotiateLanguage(r *http.Request, supported ...string) string {
+	if len(supported) == 0 {
+		return ""
+	}
+	tags, excluded := parseAcceptLanguage(r.Header.Get("Accept-Language"))
+	for _, tag := range tags {
+		if tag == "*" {
+			if match, ok := firstNotExcluded(supported, excluded); ok {
+				return match
+			}
+			continue
+		}
+		if match, ok := matchLanguage(tag, supported); ok {
+			return match
+		}
+	}
+	return supported[0]
+}
+
+// firstNotExcluded returns the first supported language that isn't matched by any of the
+// excluded tags.
+func firstNotExcluded(supported, excluded []string) (string, bool) {
+	for _, s := range supported {
+		isExcluded := false
+		for _, tag := range excluded {
+			if _, ok := matchLanguage(tag, []string{s}); ok {
+				isExcluded = true
+				break
+			}
+		}
+		if !isExcluded {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+// parseAcceptLanguage returns the language tags of the header in order of preference, and
+// the tags excluded with a quality value of zero.
+func parseAcceptLanguage(header string) (tags, excluded []string) {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var ranges []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		if _, v, ok := strings.Cut(strings.ReplaceAll(params, " ", ""), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q <= 0 {
+			excluded = append(excluded, tag)
+			continue
+		}
+		ranges = append(ranges, weighted{tag: tag, q: q})
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+	tags = make([]string, len(ranges))
+	for i, r := range ranges {
+		tags[i] = r.tag
+	}
+	return tags, excluded
+}
+
+// matchLanguage finds an exact match for the tag, then a supported language that the tag
+// is a prefix of (e.g. "en" matches "en-GB"), then repeatedly removes subtags from the end
+// of the tag to find a more general match (e.g. "en-US" matches "en").
+func matchLanguage(tag string, supported []string) (string, bool) {
+	for _, s := range supported {
+		if strings.EqualFold(s, tag) {
+			return s, true
+		}
+	}
+	for _, s := range supported {
+		if len(s) > len(tag) && strings.EqualFold(s[:len(tag)+1], tag+"-") {
+			return s, true
+		}
+	}
+	for i := strings.LastIndex(tag, "-"); i > 0; i = strings.LastIndex(tag, "-") {
+		tag = tag[:i]
+		for _, s := range supported {
+			if strings.EqualFold(s, tag) {
+				return s, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,630 @@
+package awsapigatewayv2handler
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestPagination(t *testing.T) {
+	tests := []struct {
+		name           string
+		url            string
+		expectedLimit  int
+		expectedCursor string
+	}{
+		{
+			name:          "missing values use the default limit",
+			url:           "/items",
+			expectedLimit: 20,
+		},
+		{
+			name:           "valid values are returned",
+			url:            "/items?limit=50&cursor=abc",
+			expectedLimit:  50,
+			expectedCursor: "abc",
+		},
+		{
+			name:          "limits over the maximum are clamped",
+			url:           "/items?limit=1000",
+			expectedLimit: 100,
+		},
+		{
+			name:          "non-numeric limits use the default limit",
+			url:           "/items?limit=ten",
+			expectedLimit: 20,
+		},
+		{
+			name:          "negative limits use the default limit",
+			url:           "/items?limit=-5",
+			expectedLimit: 20,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, test.url, nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			limit, cursor := Pagination(r, 20, 100)
+			if limit != test.expectedLimit {
+				t.Errorf("expected limit %d, got %d", test.expectedLimit, limit)
+			}
+			if cursor != test.expectedCursor {
+				t.Errorf("expected cursor %q, got %q", test.expectedCursor, cursor)
+			}
+		})
+	}
+}
+
+type decodeJSONTestData struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestDecodeJSON(t *testing.T) {
+	tests := []struct {
+		name          string
+		contentType   string
+		body          string
+		opts          DecodeJSONOptions
+		expected      decodeJSONTestData
+		expectedError error
+		expectError   bool
+		// expectedMessage is the message of the expected DecodeJSONError.
+		expectedMessage string
+	}{
+		{
+			name:        "valid JSON",
+			contentType: "application/json",
+			body:        `{"name":"test","count":3}`,
+			expected:    decodeJSONTestData{Name: "test", Count: 3},
+		},
+		{
+			name:        "JSON with a charset",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"name":"test"}`,
+			expected:    decodeJSONTestData{Name: "test"},
+		},
+		{
+			name:        "structured syntax suffix",
+			contentType: "application/vnd.api+json",
+			body:        `{"count":1}`,
+			expected:    decodeJSONTestData{Count: 1},
+		},
+		{
+			name:          "wrong content type",
+			contentType:   "text/plain",
+			body:          `{"name":"test"}`,
+			expectedError: ErrNotJSON,
+		},
+		{
+			name:          "missing content type",
+			body:          `{"name":"test"}`,
+			expectedError: ErrNotJSON,
+		},
+		{
+			name:          "oversized body",
+			contentType:   "application/json",
+			body:          `{"name":"` + strings.Repeat("a", 100) + `"}`,
+			opts:          DecodeJSONOptions{MaxBytes: 50},
+			expectedError: ErrBodyTooLarge,
+		},
+		{
+			name:        "unknown fields are allowed by default",
+			contentType: "application/json",
+			body:        `{"name":"test","other":true}`,
+			expected:    decodeJSONTestData{Name: "test"},
+		},
+		{
+			name:        "unknown fields can be disallowed",
+			contentType: "application/json",
+			body:        `{"name":"test","other":true}`,
+			opts:        DecodeJSONOptions{DisallowUnknownFields: true},
+			expectError: true,
+		},
+		{
+			name:            "type mismatches include the field and expected type",
+			contentType:     "application/json",
+			body:            `{"name":"test","count":"three"}`,
+			expectedMessage: `field "count" must be an integer`,
+		},
+		{
+			name:            "body of the wrong type",
+			contentType:     "application/json",
+			body:            `["test"]`,
+			expectedMessage: "request body must be an object",
+		},
+		{
+			name:            "syntax errors include the position",
+			contentType:     "application/json",
+			body:            `{"name":"test",}`,
+			expectedMessage: "request body contains invalid JSON at position 16",
+		},
+		{
+			name:            "incomplete JSON",
+			contentType:     "application/json",
+			body:            `{"name":"te`,
+			expectedMessage: "request body contains incomplete JSON",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodPost, "/items", strings.NewReader(test.body))
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			if test.contentType != "" {
+				r.Header.Set("Content-Type", test.contentType)
+			}
+
+			var actual decodeJSONTestData
+			err = DecodeJSONWithOptions(r, &actual, test.opts)
+
+			if test.expectedError != nil {
+				if !errors.Is(err, test.expectedError) {
+					t.Fatalf("expected error %v, got %v", test.expectedError, err)
+				}
+				return
+			}
+			if test.expectedMessage != "" {
+				var decodeErr *DecodeJSONError
+				if !errors.As(err, &decodeErr) {
+					t.Fatalf("expected a DecodeJSONError, got %v", err)
+				}
+				if decodeErr.Error() != test.expectedMessage {
+					t.Errorf("expected message %q, got %q", test.expectedMessage, decodeErr.Error())
+				}
+				return
+			}
+			if test.expectError {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if actual != test.expected {
+				t.Errorf("expected %+v, got %+v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestBodyIsOnlyRestoredByResetBody(t *testing.T) {
+	tests := []struct {
+		name            string
+		body            string
+		isBase64Encoded bool
+	}{
+		{
+			name: "text body",
+			body: "name=value&other=1",
+		},
+		{
+			name:            "base64 encoded body",
+			body:            base64.StdEncoding.EncodeToString([]byte("name=value&other=1")),
+			isBase64Encoded: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var formValue, consumed, body string
+			parseForm := func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if err := r.ParseForm(); err != nil {
+						t.Errorf("failed to parse form: %v", err)
+					}
+					next.ServeHTTP(w, r)
+				})
+			}
+			lh := NewLambdaHandler(parseForm(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				formValue = r.PostForm.Get("name")
+				b, _ := io.ReadAll(r.Body)
+				consumed = string(b)
+				if err := ResetBody(r); err != nil {
+					t.Errorf("failed to reset body: %v", err)
+				}
+				b, _ = io.ReadAll(r.Body)
+				body = string(b)
+			})))
+
+			_, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath:         "/path",
+				Body:            test.body,
+				IsBase64Encoded: test.isBase64Encoded,
+				Headers: map[string]string{
+					"content-type": "application/x-www-form-urlencoded",
+				},
+				RequestContext: events.APIGatewayV2HTTPRequestContext{
+					HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+						Method: http.MethodPost,
+					},
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if formValue != "value" {
+				t.Errorf("expected form value %q, got %q", "value", formValue)
+			}
+			if consumed != "" {
+				t.Errorf("expected the body to be consumed before ResetBody, got %q", consumed)
+			}
+			if body != "name=value&other=1" {
+				t.Errorf("expected body %q, got %q", "name=value&other=1", body)
+			}
+		})
+	}
+}
+
+func TestQueryCaseInsensitive(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		key      string
+		expected string
+	}{
+		{
+			name:     "same case",
+			url:      "/items?limit=10",
+			key:      "limit",
+			expected: "10",
+		},
+		{
+			name:     "different case",
+			url:      "/items?Limit=10",
+			key:      "limit",
+			expected: "10",
+		},
+		{
+			name:     "upper case key",
+			url:      "/items?limit=10",
+			key:      "LIMIT",
+			expected: "10",
+		},
+		{
+			name:     "first match is returned",
+			url:      "/items?LIMIT=5&limit=10",
+			key:      "limit",
+			expected: "5",
+		},
+		{
+			name:     "values are decoded",
+			url:      "/items?Search=a%20b+c",
+			key:      "search",
+			expected: "a b c",
+		},
+		{
+			name: "missing",
+			url:  "/items?offset=10",
+			key:  "limit",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, test.url, nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			if actual := QueryCaseInsensitive(r, test.key); actual != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	r, err := http.NewRequest(http.MethodGet, "/items", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	if actual := APIKey(r); actual != "" {
+		t.Errorf("expected empty key, got %q", actual)
+	}
+	r.Header.Add("x-api-key", "abc")
+	if actual := APIKey(r); actual != "abc" {
+		t.Errorf("expected %q, got %q", "abc", actual)
+	}
+}
+
+type decodeQueryTestData struct {
+	Limit    int     `query:"limit"`
+	Offset   uint    `query:"offset"`
+	Search   string  `query:"q"`
+	Enabled  bool    `query:"enabled"`
+	Ratio    float64 `query:"ratio"`
+	Untagged string
+}
+
+func TestDecodeQuery(t *testing.T) {
+	tests := []struct {
+		name        string
+		url         string
+		expected    decodeQueryTestData
+		expectError bool
+	}{
+		{
+			name: "mixed field types",
+			url:  "/items?limit=10&offset=20&q=hello+world&enabled=true&ratio=0.5&Untagged=x",
+			expected: decodeQueryTestData{
+				Limit:   10,
+				Offset:  20,
+				Search:  "hello world",
+				Enabled: true,
+				Ratio:   0.5,
+			},
+		},
+		{
+			name:     "missing values are left unchanged",
+			url:      "/items?q=test",
+			expected: decodeQueryTestData{Limit: 5, Search: "test"},
+		},
+		{
+			name:        "malformed int",
+			url:         "/items?limit=ten",
+			expectError: true,
+		},
+		{
+			name:        "malformed bool",
+			url:         "/items?enabled=maybe",
+			expectError: true,
+		},
+		{
+			name:        "negative uint",
+			url:         "/items?offset=-1",
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, test.url, nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+
+			actual := decodeQueryTestData{Limit: 5}
+			err = DecodeQuery(r, &actual)
+
+			if test.expectError {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if actual != test.expected {
+				t.Errorf("expected %+v, got %+v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestDecodeQueryRequiresAStructPointer(t *testing.T) {
+	r, err := http.NewRequest(http.MethodGet, "/items?limit=1", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	var notAStruct int
+	if err := DecodeQuery(r, &notAStruct); err == nil {
+		t.Error("expected an error for a non-struct pointer")
+	}
+	if err := DecodeQuery(r, decodeQueryTestData{}); err == nil {
+		t.Error("expected an error for a non-pointer")
+	}
+}
+
+func TestDecodeJSONLenient(t *testing.T) {
+	for _, contentType := range []string{"text/plain", "application/x-www-form-urlencoded", ""} {
+		t.Run(contentType, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodPost, "/items", strings.NewReader(`{"name":"test","count":2}`))
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			if contentType != "" {
+				r.Header.Set("Content-Type", contentType)
+			}
+
+			var actual decodeJSONTestData
+			if err := DecodeJSONLenient(r, &actual); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			expected := decodeJSONTestData{Name: "test", Count: 2}
+			if actual != expected {
+				t.Errorf("expected %+v, got %+v", expected, actual)
+			}
+		})
+	}
+}
+
+func TestNotFoundHandler(t *testing.T) {
+	lh := NewLambdaHandler(NotFoundHandler())
+
+	resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+		RawPath: "/missing",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+	if actual := http.Header(resp.MultiValueHeaders).Get("Content-Type"); actual != "application/json" {
+		t.Errorf("expected JSON Content-Type, got %q", actual)
+	}
+	if resp.IsBase64Encoded {
+		t.Errorf("expected the body not to be base64 encoded")
+	}
+	if expected := `{"error":{"status":404,"message":"Not Found"}}` + "\n"; resp.Body != expected {
+		t.Errorf("expected body %q, got %q", expected, resp.Body)
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+	}{
+		{
+			name:   "found",
+			status: http.StatusFound,
+		},
+		{
+			name:   "moved permanently",
+			status: http.StatusMovedPermanently,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				Redirect(w, "/new?a=b", test.status)
+			}))
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/old",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != test.status {
+				t.Errorf("expected status %d, got %d", test.status, resp.StatusCode)
+			}
+			if actual := http.Header(resp.MultiValueHeaders).Get("Location"); actual != "/new?a=b" {
+				t.Errorf("expected Location %q, got %q", "/new?a=b", actual)
+			}
+			if resp.Body != "" || resp.IsBase64Encoded {
+				t.Errorf("expected an empty body, got %q (base64=%v)", resp.Body, resp.IsBase64Encoded)
+			}
+		})
+	}
+}
+
+func TestRedirectRequiresA3xxStatus(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for a non-3xx status")
+		}
+	}()
+	Redirect(newResponseWriter(), "/new", http.StatusOK)
+}
+
+func TestAbsoluteURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		tls      bool
+		scheme   string
+		host     string
+		path     string
+		expected string
+	}{
+		{
+			name:     "https",
+			tls:      true,
+			host:     "api.example.com",
+			path:     "/items",
+			expected: "https://api.example.com/items",
+		},
+		{
+			name:     "http",
+			host:     "localhost:8000",
+			path:     "/items",
+			expected: "http://localhost:8000/items",
+		},
+		{
+			name:     "path with query",
+			tls:      true,
+			host:     "api.example.com",
+			path:     "/items?cursor=abc&limit=10",
+			expected: "https://api.example.com/items?cursor=abc&limit=10",
+		},
+		{
+			name:     "relative path",
+			tls:      true,
+			host:     "api.example.com",
+			path:     "items",
+			expected: "https://api.example.com/items",
+		},
+		{
+			name:     "URL scheme",
+			scheme:   "https",
+			host:     "api.example.com",
+			path:     "/items",
+			expected: "https://api.example.com/items",
+		},
+		{
+			name:     "URL scheme takes precedence over TLS",
+			tls:      true,
+			scheme:   "http",
+			host:     "localhost:8000",
+			path:     "/items",
+			expected: "http://localhost:8000/items",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, "/", nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			r.Host = test.host
+			r.URL.Scheme = test.scheme
+			if test.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+
+			if actual := AbsoluteURL(r, test.path); actual != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestNegotiateLanguage(t *testing.T) {
+	supported := []string{"en-GB", "fr", "de-DE"}
+	tests := []struct {
+		acceptLanguage string
+		expected       string
+	}{
+		{acceptLanguage: "", expected: "en-GB"},
+		{acceptLanguage: "fr", expected: "fr"},
+		{acceptLanguage: "FR-ca", expected: "fr"},
+		{acceptLanguage: "de", expected: "de-DE"},
+		{acceptLanguage: "es", expected: "en-GB"},
+		{acceptLanguage: "es, fr;q=0.5, de;q=0.8", expected: "de-DE"},
+		{acceptLanguage: "fr;q=0.2, de-DE;q=0.9, en-GB;q=0.4", expected: "de-DE"},
+		{acceptLanguage: "de;q=0, fr;q=0.1", expected: "fr"},
+		{acceptLanguage: "es, *;q=0.5", expected: "en-GB"},
+		{acceptLanguage: "*", expected: "en-GB"},
+		{acceptLanguage: "en;q=0, *", expected: "fr"},
+		{acceptLanguage: "en-GB;q=0, fr;q=0, *;q=0.5", expected: "de-DE"},
+		{acceptLanguage: "es, fr;q=invalid", expected: "en-GB"},
+	}
+	for _, test := range tests {
+		t.Run(test.acceptLanguage, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, "/", nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			r.Header.Set("Accept-Language", test.acceptLanguage)
+
+			if actual := NegotiateLanguage(r, supported...); actual != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package awsapigatewayv2handler
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// coldStart records whether a LambdaHandler has handled an invocation.
+type coldStart struct {
+	invoked int32
+}
+
+// take returns true for the first invocation, and false afterwards.
+func (c *coldStart) take() bool {
+	return atomic.CompareAndSwapInt32(&c.invoked, 0, 1)
+}
+
+func (c *coldStart) reset() {
+	atomic.StoreInt32(&c.invoked, 0)
+}
+
+// processColdStart is used by handlers that weren't created with NewLambdaHandler. Each
+// execution environment is a new process, so the first invocation in the process is the cold
+// start.
+var processColdStart coldStart
+
+// getColdStart returns the cold start state of the handler.
+func (lh LambdaHandler) getColdStart() *coldStart {
+	if lh.coldStart != nil {
+		return lh.coldStart
+	}
+	return &processColdStart
+}
+
+// Invoker invokes a LambdaHandler in memory, in the same way as the Lambda runtime, for use in
+// integration tests that make multiple invocations.
+type Invoker struct {
+	lh *LambdaHandler
+	// FunctionARN is the ARN of the invoked function, available to the handler via
+	// lambdacontext.FromContext.
+	FunctionARN string
+}
+
+// NewInvoker creates an Invoker for the handler.
+func NewInvoker(lh *LambdaHandler) *Invoker {
+	if lh.coldStart == nil {
+		// Track cold starts separately from other handlers in the process.
+		lh.coldStart = &coldStart{}
+	}
+	return &Invoker{
+		lh: lh,
+	}
+}
+
+// InvokeJSON invokes the handler with the JSON event payload, returning the JSON response. A
+// Lambda context is added to ctx, unless it already has one.
+func (inv *Invoker) InvokeJSON(ctx context.Context, payload []byte) ([]byte, error) {
+	if _, ok := lambdacontext.FromContext(ctx); !ok {
+		ctx = lambdacontext.NewContext(ctx, &lambdacontext.LambdaContext{
+			AwsRequestID:       newCorrelationID(),
+			InvokedFunctionArn: inv.FunctionARN,
+		})
+	}
+	return inv.lh.Invoke(ctx, payload)
+}
+
+// Reset simulates a new execution environment, so that the next invocation is a cold start.
+func (inv *Invoker) Reset() {
+	inv.lh.getColdStart().reset()
+}
@@ -0,0 +1,85 @@
+package awsapigatewayv2handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+func TestInvoker(t *testing.T) {
+	var requestIDs []string
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lc, _ := lambdacontext.FromContext(r.Context())
+		requestIDs = append(requestIDs, lc.AwsRequestID)
+	}))
+	lh.AddColdStartHeader = true
+	invoker := NewInvoker(&lh)
+	payload := []byte(`{"version":"2.0","rawPath":"/path","requestContext":{"http":{"method":"GET"}}}`)
+
+	invoke := func() string {
+		raw, err := invoker.InvokeJSON(context.Background(), payload)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var resp events.APIGatewayV2HTTPResponse
+		if err := json.Unmarshal(raw, &resp); err != nil {
+			t.Fatalf("failed to unmarshal response: %v", err)
+		}
+		return http.Header(resp.MultiValueHeaders).Get("X-Cold-Start")
+	}
+
+	if actual := invoke(); actual != "true" {
+		t.Errorf("expected the first invocation to be a cold start, got %q", actual)
+	}
+	if actual := invoke(); actual != "false" {
+		t.Errorf("expected the second invocation to be warm, got %q", actual)
+	}
+	invoker.Reset()
+	if actual := invoke(); actual != "true" {
+		t.Errorf("expected a cold start after Reset, got %q", actual)
+	}
+
+	if len(requestIDs) != 3 || requestIDs[0] == "" || requestIDs[0] == requestIDs[1] {
+		t.Errorf("expected a unique Lambda request ID for each invocation, got %v", requestIDs)
+	}
+}
+
+func TestColdStartHeader(t *testing.T) {
+	t.Run("struct literal", func(t *testing.T) {
+		processColdStart.reset()
+		lh := LambdaHandler{
+			Handler:            http.NotFoundHandler(),
+			AddColdStartHeader: true,
+		}
+		for _, expected := range []string{"true", "false"} {
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if actual := http.Header(resp.MultiValueHeaders).Get("X-Cold-Start"); actual != expected {
+				t.Errorf("expected X-Cold-Start %q, got %q", expected, actual)
+			}
+		}
+	})
+	t.Run("set by the handler", func(t *testing.T) {
+		lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Cold-Start", "unknown")
+		}))
+		lh.AddColdStartHeader = true
+		resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+			RawPath: "/path",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if actual := http.Header(resp.MultiValueHeaders).Get("X-Cold-Start"); actual != "unknown" {
+			t.Errorf("expected the handler's X-Cold-Start header to be kept, got %q", actual)
+		}
+	})
+}
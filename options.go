@@ -0,0 +1,73 @@
+package awsapigatewayv2handler
+
+import (
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Option configures a LambdaHandler created by NewLambdaHandler or ListenAndServe.
+type Option func(*LambdaHandler)
+
+// WithTextContentTypes sets additional media types that are returned as text, rather than being
+// base64 encoded. See LambdaHandler.TextContentTypes.
+func WithTextContentTypes(mediaTypes []string) Option {
+	return func(lh *LambdaHandler) {
+		lh.TextContentTypes = mediaTypes
+	}
+}
+
+// WithTextTypeFunc replaces the default text type detection. See LambdaHandler.TextTypeFunc.
+func WithTextTypeFunc(f func(mediaType string) bool) Option {
+	return func(lh *LambdaHandler) {
+		lh.TextTypeFunc = f
+	}
+}
+
+// WithStagePrefixStripping removes the API Gateway stage from the start of request paths. See
+// LambdaHandler.StripStagePrefix.
+func WithStagePrefixStripping() Option {
+	return func(lh *LambdaHandler) {
+		lh.StripStagePrefix = true
+	}
+}
+
+// WithBasePath removes the base path, e.g. "/prod", from the start of request paths. See
+// LambdaHandler.BasePath.
+func WithBasePath(basePath string) Option {
+	return func(lh *LambdaHandler) {
+		lh.BasePath = basePath
+	}
+}
+
+// WithObserver sets a function that's called with the details of each request once it has
+// been handled. See LambdaHandler.Observer.
+func WithObserver(f func(info RequestInfo)) Option {
+	return func(lh *LambdaHandler) {
+		lh.Observer = f
+	}
+}
+
+// WithRecover sets whether panics in the handler are recovered. See LambdaHandler.RecoverPanics.
+func WithRecover(enabled bool) Option {
+	return func(lh *LambdaHandler) {
+		lh.RecoverPanics = enabled
+	}
+}
+
+// WithPanicHandler recovers panics in the handler, and uses f to write the response. See
+// LambdaHandler.PanicHandler.
+func WithPanicHandler(f func(w http.ResponseWriter, r *http.Request, recovered interface{})) Option {
+	return func(lh *LambdaHandler) {
+		lh.RecoverPanics = true
+		lh.PanicHandler = f
+	}
+}
+
+// WithErrorHandler sets the function used to create the response when the event can't be
+// unmarshalled. See LambdaHandler.ErrorHandler.
+func WithErrorHandler(f func(err error) events.APIGatewayV2HTTPResponse) Option {
+	return func(lh *LambdaHandler) {
+		lh.ErrorHandler = f
+	}
+}
@@ -0,0 +1,393 @@
+package awsapigatewayv2handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestOptions(t *testing.T) {
+	var calls []string
+	lh := NewLambdaHandler(http.NotFoundHandler(),
+		func(lh *LambdaHandler) {
+			calls = append(calls, "first")
+			lh.MaxRequestHeaders = 10
+		},
+		func(lh *LambdaHandler) {
+			calls = append(calls, "second")
+			lh.MaxRequestHeaders = 20
+		},
+	)
+
+	if len(calls) != 2 || calls[0] != "first" || calls[1] != "second" {
+		t.Errorf("expected options to be applied in order, got %v", calls)
+	}
+	if lh.MaxRequestHeaders != 20 {
+		t.Errorf("expected MaxRequestHeaders to be 20, got %d", lh.MaxRequestHeaders)
+	}
+}
+
+func TestTextContentTypes(t *testing.T) {
+	tests := []struct {
+		name            string
+		contentType     string
+		opts            []Option
+		expectedEncoded bool
+	}{
+		{
+			name:            "default",
+			contentType:     "application/wasm",
+			expectedEncoded: true,
+		},
+		{
+			name:            "additional media type",
+			contentType:     "application/vnd.api+json; charset=utf-8",
+			opts:            []Option{WithTextContentTypes([]string{"application/vnd.api+json"})},
+			expectedEncoded: false,
+		},
+		{
+			name:        "function",
+			contentType: "text/plain; charset=utf-8",
+			opts: []Option{WithTextTypeFunc(func(mediaType string) bool {
+				return mediaType == "application/wasm"
+			})},
+			expectedEncoded: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", test.contentType)
+				io.WriteString(w, "body")
+			}), test.opts...)
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.IsBase64Encoded != test.expectedEncoded {
+				t.Errorf("expected IsBase64Encoded to be %v, got %v", test.expectedEncoded, resp.IsBase64Encoded)
+			}
+		})
+	}
+}
+
+func TestRecoverOptions(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "partial")
+		panic("something went wrong")
+	})
+	tests := []struct {
+		name         string
+		opt          Option
+		expectedBody string
+		expectedType string
+	}{
+		{
+			name:         "WithRecover",
+			opt:          WithRecover(true),
+			expectedBody: "Internal Server Error\n",
+			expectedType: "text/plain; charset=utf-8",
+		},
+		{
+			name: "WithPanicHandler",
+			opt: WithPanicHandler(func(w http.ResponseWriter, r *http.Request, recovered interface{}) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, `{"error":%q}`, recovered)
+			}),
+			expectedBody: `{"error":"something went wrong"}`,
+			expectedType: "application/json",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lh := NewLambdaHandler(handler, test.opt)
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != http.StatusInternalServerError {
+				t.Errorf("expected status %d, got %d", http.StatusInternalServerError, resp.StatusCode)
+			}
+			if resp.Body != test.expectedBody {
+				t.Errorf("expected body %q, got %q", test.expectedBody, resp.Body)
+			}
+			if ct := http.Header(resp.MultiValueHeaders).Get("Content-Type"); ct != test.expectedType {
+				t.Errorf("expected Content-Type %q, got %q", test.expectedType, ct)
+			}
+		})
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	payload := []byte(`{"rawPath":123}`)
+	t.Run("default", func(t *testing.T) {
+		lh := NewLambdaHandler(http.NotFoundHandler())
+
+		_, err := lh.Invoke(context.Background(), payload)
+		if err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+	t.Run("custom", func(t *testing.T) {
+		var received error
+		lh := NewLambdaHandler(http.NotFoundHandler(), WithErrorHandler(func(err error) events.APIGatewayV2HTTPResponse {
+			received = err
+			return events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusBadRequest,
+				Headers:    map[string]string{"Content-Type": "application/json"},
+				Body:       `{"error":"invalid event"}`,
+			}
+		}))
+
+		raw, err := lh.Invoke(context.Background(), payload)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if received == nil {
+			t.Errorf("expected the error handler to receive the error")
+		}
+		var resp events.APIGatewayV2HTTPResponse
+		if err := json.Unmarshal(raw, &resp); err != nil {
+			t.Fatalf("error unmarshalling response: %v", err)
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+		if resp.Body != `{"error":"invalid event"}` {
+			t.Errorf("unexpected body %q", resp.Body)
+		}
+	})
+}
+
+func TestStagePrefixStripping(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         []Option
+		rawPath      string
+		stage        string
+		expectedPath string
+	}{
+		{
+			name:         "disabled",
+			rawPath:      "/prod/users/123",
+			stage:        "prod",
+			expectedPath: "/prod/users/123",
+		},
+		{
+			name:         "stage is removed",
+			opts:         []Option{WithStagePrefixStripping()},
+			rawPath:      "/prod/users/123",
+			stage:        "prod",
+			expectedPath: "/users/123",
+		},
+		{
+			name:         "stage root",
+			opts:         []Option{WithStagePrefixStripping()},
+			rawPath:      "/prod",
+			stage:        "prod",
+			expectedPath: "/",
+		},
+		{
+			name:         "default stage isn't removed",
+			opts:         []Option{WithStagePrefixStripping()},
+			rawPath:      "/$default/users",
+			stage:        "$default",
+			expectedPath: "/$default/users",
+		},
+		{
+			name:         "custom domain has already removed the stage",
+			opts:         []Option{WithStagePrefixStripping()},
+			rawPath:      "/users/prod",
+			stage:        "prod",
+			expectedPath: "/users/prod",
+		},
+		{
+			name:         "stage is only removed once",
+			opts:         []Option{WithStagePrefixStripping()},
+			rawPath:      "/prod/prod/users",
+			stage:        "prod",
+			expectedPath: "/prod/users",
+		},
+		{
+			name:         "partial segment isn't removed",
+			opts:         []Option{WithStagePrefixStripping()},
+			rawPath:      "/production/users",
+			stage:        "prod",
+			expectedPath: "/production/users",
+		},
+		{
+			name:         "base path",
+			opts:         []Option{WithBasePath("/api/")},
+			rawPath:      "/api/users",
+			stage:        "prod",
+			expectedPath: "/users",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var actual string
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				actual = r.URL.Path
+			}), test.opts...)
+
+			_, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: test.rawPath,
+				RequestContext: events.APIGatewayV2HTTPRequestContext{
+					Stage: test.stage,
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if actual != test.expectedPath {
+				t.Errorf("expected path %q, got %q", test.expectedPath, actual)
+			}
+		})
+	}
+}
+
+func TestObserver(t *testing.T) {
+	tests := []struct {
+		name           string
+		handler        http.HandlerFunc
+		recoverPanics  bool
+		opts           []Option
+		expectedStatus int
+		expectPanic    bool
+	}{
+		{
+			name: "status code",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusCreated)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "default status code",
+			handler:        func(w http.ResponseWriter, r *http.Request) {},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "recovered panic",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+				panic("something went wrong")
+			},
+			recoverPanics:  true,
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name: "unrecovered panic",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				panic("something went wrong")
+			},
+			expectedStatus: http.StatusInternalServerError,
+			expectPanic:    true,
+		},
+		{
+			name: "panic handler",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				panic("something went wrong")
+			},
+			recoverPanics: true,
+			opts: []Option{func(lh *LambdaHandler) {
+				lh.PanicHandler = func(w http.ResponseWriter, r *http.Request, recovered interface{}) {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}},
+			expectedStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name: "rejected request",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				t.Error("expected the handler not to be called")
+			},
+			opts: []Option{func(lh *LambdaHandler) {
+				lh.RequiredBearerToken = "secret"
+			}},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "too many headers",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				t.Error("expected the handler not to be called")
+			},
+			opts: []Option{func(lh *LambdaHandler) {
+				lh.MaxRequestHeaders = 1
+			}},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "status not allowed",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			},
+			opts: []Option{func(lh *LambdaHandler) {
+				lh.AllowedStatusCodes = []int{http.StatusOK}
+			}},
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var infos []RequestInfo
+			opts := append([]Option{WithRecover(test.recoverPanics), WithObserver(func(info RequestInfo) {
+				infos = append(infos, info)
+			}), func(lh *LambdaHandler) {
+				lh.OnError = func(err error) {}
+			}}, test.opts...)
+			lh := NewLambdaHandler(test.handler, opts...)
+
+			func() {
+				defer func() {
+					if r := recover(); (r != nil) != test.expectPanic {
+						t.Errorf("expected panic to be %v, got %v", test.expectPanic, r)
+					}
+				}()
+				lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+					RawPath: "/path",
+					Headers: map[string]string{"accept": "*/*", "user-agent": "test"},
+					RequestContext: events.APIGatewayV2HTTPRequestContext{
+						RequestID: "c6af9ac6-7b61-11e6-9a41-93e8deadbeef",
+						HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+							Method: http.MethodPut,
+						},
+					},
+				})
+			}()
+
+			if len(infos) != 1 {
+				t.Fatalf("expected the observer to be called once, got %d calls", len(infos))
+			}
+			info := infos[0]
+			if info.Method != http.MethodPut || info.Path != "/path" {
+				t.Errorf("expected PUT /path, got %s %s", info.Method, info.Path)
+			}
+			if info.StatusCode != test.expectedStatus {
+				t.Errorf("expected status %d, got %d", test.expectedStatus, info.StatusCode)
+			}
+			if info.RequestID != "c6af9ac6-7b61-11e6-9a41-93e8deadbeef" {
+				t.Errorf("expected request ID %q, got %q", "c6af9ac6-7b61-11e6-9a41-93e8deadbeef", info.RequestID)
+			}
+			if info.Duration < 0 {
+				t.Errorf("expected a non-negative duration, got %v", info.Duration)
+			}
+		})
+	}
+}
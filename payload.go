@@ -0,0 +1,50 @@
+package awsapigatewayv2handler
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+type payloadFormat int
+
+const (
+	payloadFormatV2 payloadFormat = iota
+	payloadFormatV1
+	payloadFormatALB
+	payloadFormatWebSocket
+)
+
+// getPayloadFormat determines the type of event in the payload. API Gateway V2 (HTTP API)
+// events have a version of "2.0", while API Gateway V1 (REST API) and ALB target group events
+// have a httpMethod field. ALB events are distinguished by the elb request context, and
+// WebSocket events by the connection ID.
+func getPayloadFormat(payload []byte) payloadFormat {
+	// Avoid unmarshalling the payload twice for V2 events.
+	if !bytes.Contains(payload, []byte(`"httpMethod"`)) && !bytes.Contains(payload, []byte(`"connectionId"`)) {
+		return payloadFormatV2
+	}
+	var probe struct {
+		Version        string `json:"version"`
+		HTTPMethod     string `json:"httpMethod"`
+		RequestContext struct {
+			ELB          json.RawMessage `json:"elb"`
+			ConnectionID string          `json:"connectionId"`
+		} `json:"requestContext"`
+	}
+	if err := json.Unmarshal(payload, &probe); err != nil {
+		return payloadFormatV2
+	}
+	if probe.Version == "2.0" {
+		return payloadFormatV2
+	}
+	if probe.RequestContext.ConnectionID != "" {
+		return payloadFormatWebSocket
+	}
+	if probe.HTTPMethod == "" {
+		return payloadFormatV2
+	}
+	if len(probe.RequestContext.ELB) > 0 {
+		return payloadFormatALB
+	}
+	return payloadFormatV1
+}
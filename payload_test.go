@@ -0,0 +1,49 @@
+package awsapigatewayv2handler
+
+import "testing"
+
+func TestGetPayloadFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		expected payloadFormat
+	}{
+		{
+			name:     "V2",
+			payload:  `{"version":"2.0","rawPath":"/","requestContext":{"http":{"method":"GET"}}}`,
+			expected: payloadFormatV2,
+		},
+		{
+			name:     "V2 without a version",
+			payload:  `{"rawPath":"/","requestContext":{"http":{"method":"GET"}}}`,
+			expected: payloadFormatV2,
+		},
+		{
+			name:     "V1",
+			payload:  `{"version":"1.0","resource":"/","path":"/","httpMethod":"GET"}`,
+			expected: payloadFormatV1,
+		},
+		{
+			name:     "V1 without a version",
+			payload:  `{"resource":"/","path":"/","httpMethod":"GET"}`,
+			expected: payloadFormatV1,
+		},
+		{
+			name:     "ALB",
+			payload:  `{"path":"/","httpMethod":"GET","requestContext":{"elb":{"targetGroupArn":"arn"}}}`,
+			expected: payloadFormatALB,
+		},
+		{
+			name:     "WebSocket",
+			payload:  `{"requestContext":{"routeKey":"$connect","eventType":"CONNECT","connectionId":"L0SM9cOFvHcCIhw="}}`,
+			expected: payloadFormatWebSocket,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := getPayloadFormat([]byte(test.payload)); actual != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
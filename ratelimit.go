@@ -0,0 +1,131 @@
+package awsapigatewayv2handler
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRateLimiterKeys is the number of keys tracked before the buckets that have refilled are
+// removed.
+const maxRateLimiterKeys = 10000
+
+// RateLimiter limits the rate of requests for each key, e.g. each source IP, using a token
+// bucket. Requests that exceed the limit are rejected with a 429 status and a Retry-After
+// header.
+//
+// The limiter only applies to requests handled by the same Lambda execution environment, so
+// the effective limit increases as Lambda scales out.
+type RateLimiter struct {
+	// Rate is the number of requests per second allowed for each key.
+	Rate float64
+	// Burst is the maximum number of requests allowed at once for each key. If it's zero or
+	// less, the burst is the number of requests allowed per second, rounded up, and at least 1.
+	Burst int
+	// KeyFunc returns the key that requests are limited by. Defaults to the source IP of the
+	// request.
+	KeyFunc func(r *http.Request) string
+
+	m       sync.Mutex
+	buckets map[string]*tokenBucket
+	// now returns the current time, and can be replaced in tests.
+	now func() time.Time
+}
+
+// NewRateLimiter creates a RateLimiter that allows rate requests per second for each source IP,
+// with bursts of up to burst requests.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		Rate:  rate,
+		Burst: burst,
+	}
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// allow takes a token from the bucket for the request's key. If there are no tokens left,
+// ok is false, and retryAfter is the time until a token is available.
+func (rl *RateLimiter) allow(r *http.Request) (ok bool, retryAfter time.Duration) {
+	key := sourceIP(r)
+	if rl.KeyFunc != nil {
+		key = rl.KeyFunc(r)
+	}
+	now := time.Now()
+	if rl.now != nil {
+		now = rl.now()
+	}
+
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	if rl.buckets == nil {
+		rl.buckets = make(map[string]*tokenBucket)
+	}
+	b, exists := rl.buckets[key]
+	if !exists {
+		if len(rl.buckets) >= maxRateLimiterKeys {
+			rl.removeFullBuckets(now)
+		}
+		b = &tokenBucket{tokens: rl.burst(), updated: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = rl.refill(b, now)
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if rl.Rate <= 0 {
+		return false, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rl.Rate * float64(time.Second))
+}
+
+// refill returns the number of tokens in the bucket at the time now.
+func (rl *RateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed <= 0 {
+		return b.tokens
+	}
+	return math.Min(rl.burst(), b.tokens+elapsed*rl.Rate)
+}
+
+// burst returns the maximum number of tokens in a bucket.
+func (rl *RateLimiter) burst() float64 {
+	if rl.Burst > 0 {
+		return float64(rl.Burst)
+	}
+	return math.Max(1, math.Ceil(rl.Rate))
+}
+
+// removeFullBuckets removes the buckets that have refilled, since they're equivalent to new
+// buckets.
+func (rl *RateLimiter) removeFullBuckets(now time.Time) {
+	for key, b := range rl.buckets {
+		if rl.refill(b, now) >= rl.burst() {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// rejectRateLimited writes a 429 response, with a Retry-After header if the time until the next
+// request is allowed is known.
+func rejectRateLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
+// sourceIP returns the IP address of the client, without the port.
+func sourceIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
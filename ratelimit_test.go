@@ -0,0 +1,145 @@
+package awsapigatewayv2handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC)
+	rl := NewRateLimiter(1, 3)
+	rl.now = func() time.Time { return now }
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	lh.RateLimiter = rl
+
+	request := func(sourceIP string) events.APIGatewayV2HTTPResponse {
+		resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+			RawPath: "/path",
+			RequestContext: events.APIGatewayV2HTTPRequestContext{
+				HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+					SourceIP: sourceIP,
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return resp
+	}
+
+	// The burst is allowed.
+	for i := 0; i < 3; i++ {
+		if resp := request("192.0.2.1"); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("request %d: expected status %d, got %d", i, http.StatusNoContent, resp.StatusCode)
+		}
+	}
+	// Further requests are rejected.
+	resp := request("192.0.2.1")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d, got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+	if retryAfter := http.Header(resp.MultiValueHeaders).Get("Retry-After"); retryAfter != "1" {
+		t.Errorf("expected Retry-After %q, got %q", "1", retryAfter)
+	}
+	// Other source IPs have their own bucket.
+	if resp := request("192.0.2.2"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected status %d for another source IP, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	// A token is added each second.
+	now = now.Add(time.Second)
+	if resp := request("192.0.2.1"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected status %d after a second, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	if resp := request("192.0.2.1"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+	// The bucket refills up to the burst.
+	now = now.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		if resp := request("192.0.2.1"); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("request %d after recovering: expected status %d, got %d", i, http.StatusNoContent, resp.StatusCode)
+		}
+	}
+	if resp := request("192.0.2.1"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+}
+
+func TestRateLimiterKeyFunc(t *testing.T) {
+	now := time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC)
+	rl := NewRateLimiter(0.5, 1)
+	rl.KeyFunc = func(r *http.Request) string {
+		return r.Header.Get("X-Api-Key")
+	}
+	rl.now = func() time.Time { return now }
+	lh := NewLambdaHandler(http.NotFoundHandler())
+	lh.RateLimiter = rl
+
+	request := func(key string) events.APIGatewayV2HTTPResponse {
+		resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+			RawPath: "/path",
+			Headers: map[string]string{
+				"x-api-key": key,
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return resp
+	}
+
+	if resp := request("a"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+	resp := request("a")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+	if retryAfter := http.Header(resp.MultiValueHeaders).Get("Retry-After"); retryAfter != "2" {
+		t.Errorf("expected Retry-After %q, got %q", "2", retryAfter)
+	}
+	if resp := request("b"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status %d for another key, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestRateLimiterDefaultBurst(t *testing.T) {
+	tests := []struct {
+		rate          float64
+		expectedBurst int
+	}{
+		{rate: 0.5, expectedBurst: 1},
+		{rate: 1, expectedBurst: 1},
+		{rate: 2.5, expectedBurst: 3},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.rate), func(t *testing.T) {
+			now := time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC)
+			rl := NewRateLimiter(test.rate, 0)
+			rl.now = func() time.Time { return now }
+			r := httptest.NewRequest(http.MethodGet, "/path", nil)
+
+			for i := 0; i < test.expectedBurst; i++ {
+				if ok, _ := rl.allow(r); !ok {
+					t.Fatalf("request %d: expected the request to be allowed", i)
+				}
+			}
+			if ok, _ := rl.allow(r); ok {
+				t.Errorf("expected the request after the burst to be rejected")
+			}
+			// Requests are allowed again once the bucket refills.
+			now = now.Add(time.Minute)
+			if ok, _ := rl.allow(r); !ok {
+				t.Errorf("expected the request to be allowed after the bucket refills")
+			}
+		})
+	}
+}
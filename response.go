@@ -0,0 +1,178 @@
+package awsapigatewayv2handler
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// responseWriter records the response written by a http.Handler in the same way as
+// httptest.ResponseRecorder, but allows the recorded response to be modified before
+// it's converted to an API Gateway response.
+type responseWriter struct {
+	// header is the header map modified by the handler.
+	header http.Header
+	// result is the header map snapshotted when the header was written, with trailers
+	// added when the response is finished.
+	result      http.Header
+	statusCode  int
+	body        bytes.Buffer
+	wroteHeader bool
+	// contentLength is the Content-Length set by the handler, or -1 if it wasn't set.
+	contentLength int64
+}
+
+func newResponseWriter() *responseWriter {
+	return &responseWriter{
+		header:        make(http.Header),
+		statusCode:    http.StatusOK,
+		contentLength: -1,
+	}
+}
+
+// maxPooledBufferSize is the largest body buffer that's returned to the pool, so that a single
+// large response doesn't keep its memory allocated for the lifetime of the function.
+const maxPooledBufferSize = 64 * 1024
+
+var responseWriterPool = sync.Pool{
+	New: func() interface{} {
+		return &responseWriter{}
+	},
+}
+
+// getResponseWriter returns a responseWriter from the pool, which must be returned with
+// putResponseWriter once the response has been converted.
+func getResponseWriter() *responseWriter {
+	w := responseWriterPool.Get().(*responseWriter)
+	w.reset()
+	return w
+}
+
+// putResponseWriter returns the responseWriter to the pool. The header maps are handed to
+// the API Gateway response, so only the body buffer is reused, and nothing must refer to
+// the body's memory after it's returned.
+func putResponseWriter(w *responseWriter) {
+	if w.body.Cap() > maxPooledBufferSize {
+		return
+	}
+	w.header = nil
+	w.result = nil
+	w.body.Reset()
+	responseWriterPool.Put(w)
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+// Write writes to the body. Like the net/http server, writes beyond the Content-Length set by
+// the handler return http.ErrContentLength.
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.writeHeader(p)
+	if remaining := w.remaining(); int64(len(p)) > remaining {
+		n, _ := w.body.Write(p[:remaining])
+		return n, http.ErrContentLength
+	}
+	return w.body.Write(p)
+}
+
+func (w *responseWriter) WriteString(s string) (int, error) {
+	w.writeHeader([]byte(s))
+	if remaining := w.remaining(); int64(len(s)) > remaining {
+		n, _ := w.body.WriteString(s[:remaining])
+		return n, http.ErrContentLength
+	}
+	return w.body.WriteString(s)
+}
+
+// remaining returns the number of bytes that can be written before the Content-Length is
+// exceeded.
+func (w *responseWriter) remaining() int64 {
+	if w.contentLength < 0 {
+		return math.MaxInt64
+	}
+	if n := w.contentLength - int64(w.body.Len()); n > 0 {
+		return n
+	}
+	return 0
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	if code < 100 || code > 999 {
+		panic(fmt.Sprintf("invalid WriteHeader code %v", code))
+	}
+	w.wroteHeader = true
+	w.statusCode = code
+	w.result = w.header.Clone()
+	w.contentLength = -1
+	if cl := w.result.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil && n >= 0 {
+			w.contentLength = n
+		}
+	}
+}
+
+// writeHeader writes the header before the first write of the body, detecting the
+// Content-Type if it hasn't been set.
+func (w *responseWriter) writeHeader(p []byte) {
+	if w.wroteHeader {
+		return
+	}
+	_, hasType := w.header["Content-Type"]
+	hasTE := w.header.Get("Transfer-Encoding") != ""
+	if !hasType && !hasTE {
+		w.header.Set("Content-Type", http.DetectContentType(p))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Flush is a no-op, since the response is sent to API Gateway once the handler returns.
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// reset discards everything written to the response.
+func (w *responseWriter) reset() {
+	w.header = make(http.Header)
+	w.result = nil
+	w.statusCode = http.StatusOK
+	w.body.Reset()
+	w.wroteHeader = false
+	w.contentLength = -1
+}
+
+// finish completes the response once the handler has returned, adding any trailers
+// to the result.
+func (w *responseWriter) finish() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	for _, declared := range w.result.Values("Trailer") {
+		for _, k := range strings.Split(declared, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			if v, ok := w.header[k]; ok {
+				w.result[k] = v
+			}
+		}
+	}
+	for k, v := range w.header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			w.result[http.CanonicalHeaderKey(strings.TrimPrefix(k, http.TrailerPrefix))] = v
+		}
+	}
+}
+
+func (w *responseWriter) cookies() []*http.Cookie {
+	return (&http.Response{Header: w.result}).Cookies()
+}
+
+var _ http.Flusher = &responseWriter{}
@@ -0,0 +1,234 @@
+package awsapigatewayv2handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// ListenAndServeStreaming starts a Lambda handler that streams responses. See
+// NewStreamingLambdaHandler.
+func ListenAndServeStreaming(h http.Handler, opts ...Option) {
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	lambda.Start(NewStreamingLambdaHandler(h, opts...).Handle)
+}
+
+// StreamingLambdaHandler handles Lambda Function URL events for functions with an InvokeMode
+// of RESPONSE_STREAM. The response body is streamed to the client as the handler writes it,
+// rather than being buffered in memory, so it's suitable for large responses.
+//
+// Streaming responses require compiling with `-tags lambda.norpc`, or using the `provided.al2`
+// runtime.
+type StreamingLambdaHandler struct {
+	lh LambdaHandler
+}
+
+// NewStreamingLambdaHandler creates a handler that streams responses. The options that
+// apply to the request, such as RequiredBearerToken, are supported. Options that post-process
+// the response, such as CompressResponses, are not applied. Panics are always recovered.
+func NewStreamingLambdaHandler(h http.Handler, opts ...Option) StreamingLambdaHandler {
+	return StreamingLambdaHandler{
+		lh: NewLambdaHandler(h, opts...),
+	}
+}
+
+// Handle executes the handler. It returns as soon as the handler writes the status code, the
+// first part of the body, or flushes. The rest of the body is read from the response as the
+// handler writes it.
+func (sh StreamingLambdaHandler) Handle(ctx context.Context, e events.APIGatewayV2HTTPRequest) (*events.LambdaFunctionURLStreamingResponse, error) {
+	lh := sh.lh
+	start := time.Now()
+	inv := newInvocation(e)
+	observe := func(statusCode int, failed bool) {
+		if lh.Observer != nil {
+			lh.observe(inv, statusCode, failed, time.Since(start))
+		}
+	}
+	r, err := lh.convertLambdaEventToHTTPRequest(e)
+	if err != nil {
+		resp, err := lh.badRequestResponse(err)
+		observe(resp.StatusCode, err != nil)
+		if err != nil {
+			return nil, err
+		}
+		return newStreamingResponse(resp)
+	}
+	r, cancel := lh.prepareRequest(withEvent(ctx, e), inv, r)
+
+	rejected := newResponseWriter()
+	if !lh.validateRequest(rejected, r) {
+		cancel()
+		rejected.finish()
+		resp, err := lh.convertHTTPResponseToLambdaEvent(rejected)
+		observe(resp.StatusCode, err != nil)
+		if err != nil {
+			return nil, err
+		}
+		return newStreamingResponse(resp)
+	}
+
+	// The handler runs in its own goroutine, so a panic can't be returned to the Lambda
+	// runtime, and is always recovered.
+	lh.RecoverPanics = true
+	pr, pw := io.Pipe()
+	w := newStreamWriter(pw)
+	done := make(chan struct{})
+	// closed is set once the handler has finished writing, after which the response must end
+	// with the writer's error, or io.EOF, rather than the context's error.
+	var m sync.Mutex
+	var closed bool
+	closeWriter := func(err error) {
+		m.Lock()
+		defer m.Unlock()
+		closed = true
+		pw.CloseWithError(err)
+	}
+	go func() {
+		// If the response is abandoned, unblock any writes, so that the handler can return.
+		select {
+		case <-r.Context().Done():
+			m.Lock()
+			defer m.Unlock()
+			if !closed {
+				pr.CloseWithError(r.Context().Err())
+			}
+		case <-done:
+		}
+	}()
+	go func() {
+		defer func() {
+			// Stop the watcher before the context is cancelled.
+			close(done)
+			cancel()
+		}()
+		recovered, stack := lh.serveHTTP(w, r)
+		defer func() {
+			observe(w.statusCode, recovered != nil)
+		}()
+		if recovered != nil {
+			lh.logError(fmt.Errorf("handler panic: %v\n%s", recovered, stack))
+			if w.wroteHeader {
+				// The status code has already been sent, so end the stream with an error.
+				closeWriter(fmt.Errorf("handler panic: %v", recovered))
+				return
+			}
+			w.header = make(http.Header)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			closeWriter(nil)
+			return
+		}
+		if !w.wroteHeader {
+			w.WriteHeader(http.StatusOK)
+		}
+		closeWriter(nil)
+	}()
+	<-w.headerWritten
+
+	headers, cookies := splitCookies(w.result)
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: w.statusCode,
+		Headers:    headers,
+		Cookies:    cookies,
+		Body:       pr,
+	}, nil
+}
+
+// newStreamingResponse converts a buffered response to a streaming response.
+func newStreamingResponse(resp events.APIGatewayV2HTTPResponse) (*events.LambdaFunctionURLStreamingResponse, error) {
+	body := []byte(resp.Body)
+	if resp.IsBase64Encoded {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(resp.Body); err != nil {
+			return nil, err
+		}
+	}
+	headers, cookies := splitCookies(resp.MultiValueHeaders)
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: resp.StatusCode,
+		Headers:    headers,
+		Cookies:    cookies,
+		Body:       bytes.NewReader(body),
+	}, nil
+}
+
+// splitCookies combines the values of each header, returning the Set-Cookie headers separately,
+// since they can't be combined.
+func splitCookies(h http.Header) (headers map[string]string, cookies []string) {
+	headers = make(map[string]string, len(h))
+	for k, values := range h {
+		if k == "Set-Cookie" {
+			cookies = values
+			continue
+		}
+		headers[k] = strings.Join(values, ", ")
+	}
+	return headers, cookies
+}
+
+// streamWriter is a http.ResponseWriter that writes the body to a pipe.
+type streamWriter struct {
+	header        http.Header
+	result        http.Header
+	statusCode    int
+	wroteHeader   bool
+	headerWritten chan struct{}
+	pw            *io.PipeWriter
+}
+
+func newStreamWriter(pw *io.PipeWriter) *streamWriter {
+	return &streamWriter{
+		header:        make(http.Header),
+		statusCode:    http.StatusOK,
+		headerWritten: make(chan struct{}),
+		pw:            pw,
+	}
+}
+
+func (w *streamWriter) Header() http.Header {
+	return w.header
+}
+
+// Write writes to the pipe, blocking until the data is read from the response.
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		if _, hasType := w.header["Content-Type"]; !hasType && len(p) > 0 {
+			w.header.Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.pw.Write(p)
+}
+
+func (w *streamWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	if code < 100 || code > 999 {
+		panic(fmt.Sprintf("invalid WriteHeader code %v", code))
+	}
+	w.statusCode = code
+	w.wroteHeader = true
+	w.result = w.header.Clone()
+	close(w.headerWritten)
+}
+
+// Flush sends the status code and headers, if they haven't already been sent. Data is written
+// to the pipe without buffering, so there's nothing else to flush.
+func (w *streamWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+var _ http.Flusher = &streamWriter{}
@@ -0,0 +1,245 @@
+package awsapigatewayv2handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/go-cmp/cmp"
+)
+
+type streamingPrelude struct {
+	StatusCode int               `json:"statusCode"`
+	Headers    map[string]string `json:"headers"`
+	Cookies    []string          `json:"cookies"`
+}
+
+// readPrelude reads the JSON prelude of the streaming response, which is terminated by 8 null bytes.
+func readPrelude(t *testing.T, r *bufio.Reader) (prelude streamingPrelude) {
+	t.Helper()
+	var b []byte
+	for !bytes.HasSuffix(b, make([]byte, 8)) {
+		c, err := r.ReadByte()
+		if err != nil {
+			t.Fatalf("failed to read prelude: %v", err)
+		}
+		b = append(b, c)
+	}
+	if err := json.Unmarshal(b[:len(b)-8], &prelude); err != nil {
+		t.Fatalf("failed to unmarshal prelude %q: %v", b, err)
+	}
+	return prelude
+}
+
+func TestStreamingLambdaHandler(t *testing.T) {
+	release := make(chan struct{})
+	sh := NewStreamingLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		http.SetCookie(w, &http.Cookie{Name: "a", Value: "1"})
+		io.WriteString(w, "first,")
+		w.(http.Flusher).Flush()
+		// Wait until the first part has been read, to check that the body isn't buffered.
+		<-release
+		io.WriteString(w, "second")
+	}))
+
+	resp, err := sh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+		RawPath: "/path",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if resp.ContentType() != "application/vnd.awslambda.http-integration-response" {
+		t.Errorf("unexpected content type %q", resp.ContentType())
+	}
+	r := bufio.NewReader(resp)
+	prelude := readPrelude(t, r)
+	expected := streamingPrelude{
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{"Content-Type": "text/plain"},
+		Cookies:    []string{"a=1"},
+	}
+	if diff := cmp.Diff(expected, prelude); diff != "" {
+		t.Errorf("unexpected prelude:\n%s", diff)
+	}
+	first := make([]byte, len("first,"))
+	if _, err := io.ReadFull(r, first); err != nil {
+		t.Fatalf("failed to read the first part of the body: %v", err)
+	}
+	close(release)
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read the rest of the body: %v", err)
+	}
+	if body := string(first) + string(rest); body != "first,second" {
+		t.Errorf("expected body %q, got %q", "first,second", body)
+	}
+}
+
+func TestStreamingLambdaHandlerRejectedRequest(t *testing.T) {
+	sh := NewStreamingLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("expected the handler not to be called")
+	}), func(lh *LambdaHandler) {
+		lh.RequiredBearerToken = "secret"
+	})
+
+	resp, err := sh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+		RawPath: "/path",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r := bufio.NewReader(resp)
+	prelude := readPrelude(t, r)
+	if prelude.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d", http.StatusUnauthorized, prelude.StatusCode)
+	}
+	body, _ := io.ReadAll(r)
+	if string(body) != "Unauthorized\n" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
+
+func TestStreamingLambdaHandlerPanic(t *testing.T) {
+	tests := []struct {
+		name           string
+		handler        http.HandlerFunc
+		expectedStatus int
+		expectedError  bool
+	}{
+		{
+			name: "before the status is sent",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				panic("something went wrong")
+			},
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name: "after the status is sent",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "partial")
+				panic("something went wrong")
+			},
+			expectedStatus: http.StatusOK,
+			expectedError:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sh := NewStreamingLambdaHandler(test.handler, func(lh *LambdaHandler) {
+				lh.OnError = func(err error) {}
+			})
+
+			resp, err := sh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			r := bufio.NewReader(resp)
+			prelude := readPrelude(t, r)
+			if prelude.StatusCode != test.expectedStatus {
+				t.Errorf("expected status %d, got %d", test.expectedStatus, prelude.StatusCode)
+			}
+			if _, err := io.ReadAll(r); (err != nil) != test.expectedError {
+				t.Errorf("expected stream error to be %v, got %v", test.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestStreamingLambdaHandlerRequestOptions(t *testing.T) {
+	sh := NewStreamingLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := CorrelationIDFrom(r.Context())
+		io.WriteString(w, id+" "+r.URL.Query().Get("b"))
+	}), func(lh *LambdaHandler) {
+		lh.CorrelationHeader = "X-Correlation-Id"
+		lh.LegacySemicolonQuerySeparator = true
+	})
+
+	resp, err := sh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+		RawPath:        "/path",
+		RawQueryString: "a=1;b=2",
+		Headers:        map[string]string{"x-correlation-id": "abc"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r := bufio.NewReader(resp)
+	readPrelude(t, r)
+	body, _ := io.ReadAll(r)
+	if string(body) != "abc 2" {
+		t.Errorf("expected body %q, got %q", "abc 2", body)
+	}
+}
+
+func TestStreamingLambdaHandlerAbandonedResponse(t *testing.T) {
+	returned := make(chan error)
+	sh := NewStreamingLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for {
+			if _, err := io.WriteString(w, "data"); err != nil {
+				returned <- err
+				return
+			}
+		}
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err := sh.Handle(ctx, events.APIGatewayV2HTTPRequest{
+		RawPath: "/path",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	readPrelude(t, bufio.NewReader(resp))
+
+	// Stop reading the response, and cancel the invocation.
+	cancel()
+	select {
+	case err := <-returned:
+		if err != context.Canceled {
+			t.Errorf("expected write error %v, got %v", context.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the handler to return")
+	}
+}
+
+func TestStreamingLambdaHandlerHonorLambdaDeadline(t *testing.T) {
+	sh := NewStreamingLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}), func(lh *LambdaHandler) {
+		lh.HonorLambdaDeadline = true
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	resp, err := sh.Handle(ctx, events.APIGatewayV2HTTPRequest{
+		RawPath: "/path",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r := bufio.NewReader(resp)
+	readPrelude(t, r)
+	body := make([]byte, len("hello"))
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatalf("failed to read the body: %v", err)
+	}
+	// Give the handler time to return, and cancel the deadline context.
+	time.Sleep(10 * time.Millisecond)
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("expected io.EOF at the end of the body, got %d bytes and %v", n, err)
+	}
+}
@@ -0,0 +1,133 @@
+package awsapigatewayv2handler
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// HandleV1 handles API Gateway V1 (REST API) proxy events. The event is converted to a HTTP
+// request and handled in the same way as a V2 event, so all of the LambdaHandler options apply.
+func (lh LambdaHandler) HandleV1(ctx context.Context, e events.APIGatewayProxyRequest) (resp events.APIGatewayProxyResponse, err error) {
+	inv := invocation{
+		method:      e.HTTPMethod,
+		path:        e.Path,
+		sourceIP:    e.RequestContext.Identity.SourceIP,
+		userAgent:   e.RequestContext.Identity.UserAgent,
+		headerCount: len(e.Headers),
+		headerBytes: getMultiValueHeaderBytes(e.Headers, e.MultiValueHeaders),
+		body:        e.Body,
+		isBase64:    e.IsBase64Encoded,
+		header:      getHeaderFunc(e.Headers, e.MultiValueHeaders),
+		stage:       e.RequestContext.Stage,
+		requestID:   e.RequestContext.RequestID,
+	}
+	if len(e.MultiValueHeaders) > 0 {
+		inv.headerCount = len(e.MultiValueHeaders)
+	}
+	v2, err := lh.handle(withV1Event(ctx, e), inv, func() (*http.Request, error) {
+		return lh.convertV1EventToHTTPRequest(e)
+	})
+	if err != nil {
+		return
+	}
+	return convertV2ResponseToV1(v2), nil
+}
+
+// getMultiValueHeaderBytes returns the size of the headers of an event. The multi-value headers
+// are used if present.
+func getMultiValueHeaderBytes(headers map[string]string, multiValueHeaders map[string][]string) (n int) {
+	if len(multiValueHeaders) == 0 {
+		for k, v := range headers {
+			n += len(k) + len(v)
+		}
+		return n
+	}
+	for k, values := range multiValueHeaders {
+		for _, v := range values {
+			n += len(k) + len(v)
+		}
+	}
+	return n
+}
+
+func (lh LambdaHandler) convertV1EventToHTTPRequest(e events.APIGatewayProxyRequest) (req *http.Request, err error) {
+	body, cl, getBody, err := getRequestBody(e.Body, e.IsBase64Encoded)
+	if err != nil {
+		return
+	}
+	req, err = http.NewRequest(e.HTTPMethod, "/", body)
+	if err != nil {
+		return
+	}
+	req.GetBody = getBody
+	// V1 events contain the decoded path.
+	req.URL = &url.URL{Path: lh.trimBasePath(e.Path, e.RequestContext.Stage)}
+	if lh.CleanPath {
+		cleanPath(req.URL)
+	}
+	if len(e.MultiValueQueryStringParameters) > 0 {
+		req.URL.RawQuery = url.Values(e.MultiValueQueryStringParameters).Encode()
+	} else if len(e.QueryStringParameters) > 0 {
+		q := make(url.Values, len(e.QueryStringParameters))
+		for k, v := range e.QueryStringParameters {
+			q.Set(k, v)
+		}
+		req.URL.RawQuery = q.Encode()
+	}
+	req.RequestURI = requestURI((&url.URL{Path: e.Path}).EscapedPath(), req.URL.RawQuery)
+	if len(e.MultiValueHeaders) > 0 {
+		for k, values := range e.MultiValueHeaders {
+			for _, v := range values {
+				req.Header.Add(k, v)
+			}
+		}
+	} else {
+		for k, v := range e.Headers {
+			req.Header.Add(k, v)
+		}
+	}
+	setRequestHeaders(req, cl)
+	setHost(req, e.RequestContext.DomainName)
+	setProto(req, e.RequestContext.Protocol)
+	if addr := withPort(e.RequestContext.Identity.SourceIP); addr != "" {
+		req.RemoteAddr = addr
+	}
+	return
+}
+
+// convertV2ResponseToV1 converts a V2 response to the V1 format. V1 responses don't have a
+// cookies field, so cookies are returned as Set-Cookie headers.
+func convertV2ResponseToV1(resp events.APIGatewayV2HTTPResponse) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode:        resp.StatusCode,
+		Headers:           resp.Headers,
+		MultiValueHeaders: headersWithCookies(resp),
+		Body:              resp.Body,
+		IsBase64Encoded:   resp.IsBase64Encoded,
+	}
+}
+
+// headersWithCookies returns the headers of the response, including any cookies that aren't
+// already present as Set-Cookie headers.
+func headersWithCookies(resp events.APIGatewayV2HTTPResponse) map[string][]string {
+	var missing []string
+	existing := http.Header(resp.MultiValueHeaders).Values("Set-Cookie")
+	for _, c := range resp.Cookies {
+		if !contains(existing, c) {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) == 0 {
+		return resp.MultiValueHeaders
+	}
+	// Copy the headers, so that the V2 response isn't modified.
+	headers := http.Header(resp.MultiValueHeaders).Clone()
+	if headers == nil {
+		headers = make(http.Header, 1)
+	}
+	headers["Set-Cookie"] = append(headers["Set-Cookie"], missing...)
+	return headers
+}
@@ -0,0 +1,107 @@
+package awsapigatewayv2handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestV1Events(t *testing.T) {
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("expected method POST, got %q", r.Method)
+		}
+		if r.URL.Path != "/hello world" {
+			t.Errorf("expected path %q, got %q", "/hello world", r.URL.Path)
+		}
+		if r.RequestURI != "/hello%20world?id=a&id=b" {
+			t.Errorf("expected RequestURI %q, got %q", "/hello%20world?id=a&id=b", r.RequestURI)
+		}
+		if diff := cmp.Diff([]string{"a", "b"}, r.URL.Query()["id"]); diff != "" {
+			t.Errorf("unexpected query values: %s", diff)
+		}
+		if diff := cmp.Diff([]string{"text/plain", "text/html"}, r.Header.Values("Accept")); diff != "" {
+			t.Errorf("unexpected header values: %s", diff)
+		}
+		body, _ := io.ReadAll(r.Body)
+		http.SetCookie(w, &http.Cookie{Name: "a", Value: "1"})
+		http.SetCookie(w, &http.Cookie{Name: "b", Value: "2"})
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}))
+	payload := `{
+		"resource": "/{proxy+}",
+		"path": "/hello world",
+		"httpMethod": "POST",
+		"headers": {"Accept": "text/html"},
+		"multiValueHeaders": {"Accept": ["text/plain", "text/html"]},
+		"queryStringParameters": {"id": "b"},
+		"multiValueQueryStringParameters": {"id": ["a", "b"]},
+		"body": "aGVsbG8=",
+		"isBase64Encoded": true
+	}`
+
+	raw, err := lh.Invoke(context.Background(), []byte(payload))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var actual events.APIGatewayProxyResponse
+	if err := json.Unmarshal(raw, &actual); err != nil {
+		t.Fatalf("error unmarshalling response: %v", err)
+	}
+	if actual.StatusCode != http.StatusCreated {
+		t.Errorf("expected status %d, got %d", http.StatusCreated, actual.StatusCode)
+	}
+	if actual.Body != "hello" {
+		t.Errorf("expected body %q, got %q", "hello", actual.Body)
+	}
+	if diff := cmp.Diff([]string{"a=1", "b=2"}, actual.MultiValueHeaders["Set-Cookie"]); diff != "" {
+		t.Errorf("unexpected Set-Cookie headers: %s", diff)
+	}
+}
+
+func TestV1ResponseIncludesCookies(t *testing.T) {
+	v2 := events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		MultiValueHeaders: map[string][]string{
+			"Set-Cookie": {"a=1"},
+		},
+		Cookies: []string{"a=1", "b=2"},
+	}
+
+	v1 := convertV2ResponseToV1(v2)
+
+	if diff := cmp.Diff([]string{"a=1", "b=2"}, v1.MultiValueHeaders["Set-Cookie"]); diff != "" {
+		t.Errorf("unexpected Set-Cookie headers: %s", diff)
+	}
+	if diff := cmp.Diff([]string{"a=1"}, v2.MultiValueHeaders["Set-Cookie"]); diff != "" {
+		t.Errorf("expected the V2 response to be unmodified: %s", diff)
+	}
+}
+
+func TestV1URLIsAbsolute(t *testing.T) {
+	lh := NewLambdaHandler(http.NotFoundHandler())
+
+	r, err := lh.convertV1EventToHTTPRequest(events.APIGatewayProxyRequest{
+		HTTPMethod: http.MethodGet,
+		Path:       "/path",
+		Headers: map[string]string{
+			"Host":              "api.example.com",
+			"X-Forwarded-Proto": "https",
+		},
+		QueryStringParameters: map[string]string{"a": "1"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if expected := "https://api.example.com/path?a=1"; r.URL.String() != expected {
+		t.Errorf("expected URL %q, got %q", expected, r.URL.String())
+	}
+}
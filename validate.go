@@ -0,0 +1,134 @@
+package awsapigatewayv2handler
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// validateRequest checks the request against the handler's options. If the request is
+// rejected, the response is written to w and false is returned.
+func (lh LambdaHandler) validateRequest(w http.ResponseWriter, r *http.Request) (ok bool) {
+	if lh.RateLimiter != nil {
+		if allowed, retryAfter := lh.RateLimiter.allow(r); !allowed {
+			rejectRateLimited(w, retryAfter)
+			return false
+		}
+	}
+	if len(lh.AllowedMethods) > 0 && !contains(lh.AllowedMethods, r.Method) {
+		w.Header().Set("Allow", strings.Join(lh.AllowedMethods, ", "))
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return false
+	}
+	if lh.RejectInvalidUTF8Path && !utf8.ValidString(r.URL.Path) {
+		http.Error(w, "invalid UTF-8 in path", http.StatusBadRequest)
+		return false
+	}
+	if lh.RequireHTTPS && isPlainHTTP(r) {
+		http.Error(w, "HTTPS required", http.StatusForbidden)
+		return false
+	}
+	if lh.RequiredBearerToken != "" && !hasBearerToken(r, lh.RequiredBearerToken) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+	if len(lh.RequiredAPIKeys) > 0 && !hasAPIKey(r, lh.RequiredAPIKeys) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+	if lh.RequiredAPIVersionHeader != "" && !lh.isSupportedAPIVersion(r.Header.Get(lh.RequiredAPIVersionHeader)) {
+		http.Error(w, "missing or unsupported API version", http.StatusBadRequest)
+		return false
+	}
+	if len(lh.AcceptedContentTypes) > 0 && r.ContentLength > 0 && !lh.isAcceptedContentType(r.Header.Get("Content-Type")) {
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return false
+	}
+	if encoding, ok := lh.unsupportedRequestEncoding(r.Header.Get("Content-Encoding")); !ok {
+		if lh.RejectUnsupportedRequestEncoding {
+			w.Header().Set("Accept-Encoding", strings.Join(lh.SupportedRequestEncodings, ", "))
+			http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+			return false
+		}
+		lh.logWarning(fmt.Errorf("request for %s %s has an unsupported Content-Encoding %q", r.Method, r.URL.Path, encoding))
+	}
+	return true
+}
+
+// unsupportedRequestEncoding returns the first content coding that isn't in the
+// SupportedRequestEncodings. ok is true if all of the codings are supported.
+func (lh LambdaHandler) unsupportedRequestEncoding(contentEncoding string) (encoding string, ok bool) {
+	if contentEncoding == "" {
+		return "", true
+	}
+	for _, encoding := range strings.Split(contentEncoding, ",") {
+		encoding = strings.TrimSpace(encoding)
+		if encoding == "" || strings.EqualFold(encoding, "identity") {
+			continue
+		}
+		var supported bool
+		for _, s := range lh.SupportedRequestEncodings {
+			if strings.EqualFold(encoding, s) {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return encoding, false
+		}
+	}
+	return "", true
+}
+
+func (lh LambdaHandler) isAcceptedContentType(contentType string) bool {
+	if contentType == "" {
+		return lh.AllowMissingContentType
+	}
+	return matchesMediaType(contentType, lh.AcceptedContentTypes)
+}
+
+func (lh LambdaHandler) isSupportedAPIVersion(version string) bool {
+	if version == "" {
+		return false
+	}
+	if len(lh.SupportedAPIVersions) == 0 {
+		return true
+	}
+	for _, supported := range lh.SupportedAPIVersions {
+		if version == supported {
+			return true
+		}
+	}
+	return false
+}
+
+func hasBearerToken(r *http.Request, token string) bool {
+	scheme, actual, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(actual)), []byte(token)) == 1
+}
+
+func hasAPIKey(r *http.Request, keys map[string]bool) bool {
+	actual := []byte(APIKey(r))
+	if len(actual) == 0 {
+		return false
+	}
+	// Compare against every key, so that the time taken doesn't reveal which keys exist.
+	var matched int
+	for key, enabled := range keys {
+		if subtle.ConstantTimeCompare(actual, []byte(key)) == 1 && enabled {
+			matched++
+		}
+	}
+	return matched > 0
+}
+
+func isPlainHTTP(r *http.Request) bool {
+	proto := forwardedProto(r.Header)
+	return proto != "" && !strings.EqualFold(proto, "https")
+}
@@ -0,0 +1,381 @@
+package awsapigatewayv2handler
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/go-cmp/cmp"
+)
+
+type validationTest struct {
+	name           string
+	headers        map[string]string
+	expectedStatus int
+}
+
+func runValidationTests(t *testing.T, configure func(lh *LambdaHandler), tests []validationTest) {
+	t.Helper()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var called bool
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			}))
+			configure(&lh)
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				Headers: test.headers,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("expected status %d, got %d", test.expectedStatus, resp.StatusCode)
+			}
+			if expectCalled := test.expectedStatus == http.StatusOK; called != expectCalled {
+				t.Errorf("expected handler called to be %v, got %v", expectCalled, called)
+			}
+		})
+	}
+}
+
+func TestRequiredBearerToken(t *testing.T) {
+	runValidationTests(t, func(lh *LambdaHandler) {
+		lh.RequiredBearerToken = "secret"
+	}, []validationTest{
+		{
+			name: "matching token",
+			headers: map[string]string{
+				"authorization": "Bearer secret",
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "mismatching token",
+			headers: map[string]string{
+				"authorization": "Bearer guess",
+			},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "wrong scheme",
+			headers: map[string]string{
+				"authorization": "Basic secret",
+			},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "missing token",
+			expectedStatus: http.StatusUnauthorized,
+		},
+	})
+}
+
+func TestRequiredAPIKeys(t *testing.T) {
+	runValidationTests(t, func(lh *LambdaHandler) {
+		lh.RequiredAPIKeys = map[string]bool{
+			"key1":    true,
+			"key2":    true,
+			"revoked": false,
+		}
+	}, []validationTest{
+		{
+			name: "valid key",
+			headers: map[string]string{
+				"x-api-key": "key2",
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "invalid key",
+			headers: map[string]string{
+				"x-api-key": "key3",
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name: "disabled key",
+			headers: map[string]string{
+				"x-api-key": "revoked",
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "missing key",
+			expectedStatus: http.StatusForbidden,
+		},
+	})
+}
+
+func TestRequireHTTPS(t *testing.T) {
+	runValidationTests(t, func(lh *LambdaHandler) {
+		lh.RequireHTTPS = true
+	}, []validationTest{
+		{
+			name: "https",
+			headers: map[string]string{
+				"x-forwarded-proto": "https",
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "http",
+			headers: map[string]string{
+				"x-forwarded-proto": "http",
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name: "http in the Forwarded header",
+			headers: map[string]string{
+				"forwarded": "for=192.0.2.60;proto=http",
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+	})
+}
+
+func TestAcceptedContentTypes(t *testing.T) {
+	tests := []struct {
+		name                    string
+		contentType             string
+		body                    string
+		allowMissingContentType bool
+		expectedStatus          int
+	}{
+		{
+			name:           "accepted",
+			contentType:    "application/json; charset=utf-8",
+			body:           `{}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "rejected",
+			contentType:    "application/xml",
+			body:           `<xml/>`,
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:           "requests without a body are not checked",
+			contentType:    "application/xml",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "missing content type is rejected by default",
+			body:           `{}`,
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:                    "missing content type can be allowed",
+			body:                    `{}`,
+			allowMissingContentType: true,
+			expectedStatus:          http.StatusOK,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			lh.AcceptedContentTypes = []string{"application/json"}
+			lh.AllowMissingContentType = test.allowMissingContentType
+			headers := map[string]string{}
+			if test.contentType != "" {
+				headers["content-type"] = test.contentType
+			}
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				Headers: headers,
+				Body:    test.body,
+				RequestContext: events.APIGatewayV2HTTPRequestContext{
+					HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+						Method: "POST",
+					},
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("expected status %d, got %d", test.expectedStatus, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestRequiredAPIVersionHeader(t *testing.T) {
+	runValidationTests(t, func(lh *LambdaHandler) {
+		lh.RequiredAPIVersionHeader = "X-API-Version"
+		lh.SupportedAPIVersions = []string{"2021-01-01", "2022-01-01"}
+	}, []validationTest{
+		{
+			name: "supported version",
+			headers: map[string]string{
+				"x-api-version": "2022-01-01",
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "unsupported version",
+			headers: map[string]string{
+				"x-api-version": "2020-01-01",
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "missing version",
+			expectedStatus: http.StatusBadRequest,
+		},
+	})
+}
+
+func TestAllowedMethods(t *testing.T) {
+	tests := []struct {
+		method         string
+		expectedStatus int
+		expectedAllow  []string
+	}{
+		{method: http.MethodPost, expectedStatus: http.StatusOK},
+		{method: http.MethodDelete, expectedStatus: http.StatusMethodNotAllowed, expectedAllow: []string{"GET, POST"}},
+	}
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			var called bool
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			}))
+			lh.AllowedMethods = []string{http.MethodGet, http.MethodPost}
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				RequestContext: events.APIGatewayV2HTTPRequestContext{
+					HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+						Method: test.method,
+					},
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("expected status %d, got %d", test.expectedStatus, resp.StatusCode)
+			}
+			if expectCalled := test.expectedStatus == http.StatusOK; called != expectCalled {
+				t.Errorf("expected handler called to be %v, got %v", expectCalled, called)
+			}
+			if diff := cmp.Diff(test.expectedAllow, resp.MultiValueHeaders["Allow"]); diff != "" {
+				t.Errorf("unexpected Allow header:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRejectInvalidUTF8Path(t *testing.T) {
+	tests := []struct {
+		name           string
+		rawPath        string
+		expectedStatus int
+	}{
+		{name: "valid", rawPath: "/caf%C3%A9", expectedStatus: http.StatusOK},
+		{name: "invalid", rawPath: "/caf%FF", expectedStatus: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var called bool
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			}))
+			lh.RejectInvalidUTF8Path = true
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: test.rawPath,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("expected status %d, got %d", test.expectedStatus, resp.StatusCode)
+			}
+			if expectCalled := test.expectedStatus == http.StatusOK; called != expectCalled {
+				t.Errorf("expected handler called to be %v, got %v", expectCalled, called)
+			}
+		})
+	}
+}
+
+func TestUnsupportedRequestEncoding(t *testing.T) {
+	tests := []struct {
+		name             string
+		encoding         string
+		reject           bool
+		expectedStatus   int
+		expectedWarnings int
+	}{
+		{
+			name:           "supported",
+			encoding:       "gzip",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:             "unsupported, passed through",
+			encoding:         "br",
+			expectedStatus:   http.StatusOK,
+			expectedWarnings: 1,
+		},
+		{
+			name:           "unsupported, rejected",
+			encoding:       "br",
+			reject:         true,
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:           "one of multiple unsupported, rejected",
+			encoding:       "gzip, br",
+			reject:         true,
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var warnings []error
+			var called bool
+			lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			}))
+			lh.SupportedRequestEncodings = []string{"gzip"}
+			lh.RejectUnsupportedRequestEncoding = test.reject
+			lh.OnWarning = func(err error) {
+				warnings = append(warnings, err)
+			}
+
+			resp, err := lh.Handle(context.Background(), events.APIGatewayV2HTTPRequest{
+				RawPath: "/path",
+				Headers: map[string]string{
+					"content-encoding": test.encoding,
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("expected status %d, got %d", test.expectedStatus, resp.StatusCode)
+			}
+			if expectCalled := test.expectedStatus == http.StatusOK; called != expectCalled {
+				t.Errorf("expected handler called to be %v, got %v", expectCalled, called)
+			}
+			if len(warnings) != test.expectedWarnings {
+				t.Errorf("expected %d warnings, got %v", test.expectedWarnings, warnings)
+			}
+			if test.reject && http.Header(resp.MultiValueHeaders).Get("Accept-Encoding") != "gzip" {
+				t.Errorf("expected Accept-Encoding header %q, got %q", "gzip", resp.MultiValueHeaders["Accept-Encoding"])
+			}
+		})
+	}
+}
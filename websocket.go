@@ -0,0 +1,58 @@
+package awsapigatewayv2handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// HandleWebSocket handles API Gateway WebSocket events. The event is converted to a HTTP request
+// with the path of the route key, e.g. "/$connect", "/$disconnect" or "/$default", unless the
+// event contains a path. The method is POST, unless the event contains a method.
+//
+// The connection ID, required to send messages to the client with the API Gateway management
+// API, is available to the handler via ConnectionIDFrom.
+func (lh LambdaHandler) HandleWebSocket(ctx context.Context, e events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	method := e.HTTPMethod
+	if method == "" {
+		method = http.MethodPost
+	}
+	path := e.Path
+	if path == "" {
+		path = "/" + e.RequestContext.RouteKey
+	}
+	ctx = withConnectionID(withWebSocketEvent(ctx, e), e.RequestContext.ConnectionID)
+	return lh.HandleV1(ctx, events.APIGatewayProxyRequest{
+		Resource:                        e.Resource,
+		Path:                            path,
+		HTTPMethod:                      method,
+		Headers:                         e.Headers,
+		MultiValueHeaders:               e.MultiValueHeaders,
+		QueryStringParameters:           e.QueryStringParameters,
+		MultiValueQueryStringParameters: e.MultiValueQueryStringParameters,
+		PathParameters:                  e.PathParameters,
+		StageVariables:                  e.StageVariables,
+		RequestContext: events.APIGatewayProxyRequestContext{
+			AccountID:         e.RequestContext.AccountID,
+			Stage:             e.RequestContext.Stage,
+			RequestID:         e.RequestContext.RequestID,
+			ExtendedRequestID: e.RequestContext.ExtendedRequestID,
+			Identity:          e.RequestContext.Identity,
+			DomainName:        e.RequestContext.DomainName,
+			APIID:             e.RequestContext.APIID,
+		},
+		Body:            e.Body,
+		IsBase64Encoded: e.IsBase64Encoded,
+	})
+}
+
+func withConnectionID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, connectionIDContextKey, id)
+}
+
+// ConnectionIDFrom returns the connection ID of a WebSocket event.
+func ConnectionIDFrom(ctx context.Context) (id string, ok bool) {
+	id, ok = ctx.Value(connectionIDContextKey).(string)
+	return id, ok && id != ""
+}
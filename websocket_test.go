@@ -0,0 +1,57 @@
+package awsapigatewayv2handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestConnectionIDFrom(t *testing.T) {
+	var actualID, actualPath, actualBody string
+	var ok bool
+	lh := NewLambdaHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actualID, ok = ConnectionIDFrom(r.Context())
+		actualPath = r.URL.Path
+		body, _ := io.ReadAll(r.Body)
+		actualBody = string(body)
+	}))
+	payload := `{
+		"requestContext": {
+			"routeKey": "$default",
+			"eventType": "MESSAGE",
+			"connectionId": "L0SM9cOFvHcCIhw=",
+			"stage": "prod"
+		},
+		"body": "hello",
+		"isBase64Encoded": false
+	}`
+
+	raw, err := lh.Invoke(context.Background(), []byte(payload))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var resp events.APIGatewayProxyResponse
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		t.Fatalf("error unmarshalling response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if !ok || actualID != "L0SM9cOFvHcCIhw=" {
+		t.Errorf("expected connection ID %q, got %q", "L0SM9cOFvHcCIhw=", actualID)
+	}
+	if actualPath != "/$default" {
+		t.Errorf("expected path %q, got %q", "/$default", actualPath)
+	}
+	if actualBody != "hello" {
+		t.Errorf("expected body %q, got %q", "hello", actualBody)
+	}
+	if _, ok := ConnectionIDFrom(context.Background()); ok {
+		t.Errorf("expected no connection ID in an empty context")
+	}
+}